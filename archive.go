@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffixes of the archives a root_path can point to
+var archiveSuffixes = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+func isArchive(rootPath string) bool {
+	lower := strings.ToLower(rootPath)
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// openedArchive is an archive indexed by rootFS, kept until the file changes
+type openedArchive struct {
+	fsys    fs.FS
+	size    int64
+	modTime time.Time
+}
+
+var (
+	archivesMu sync.Mutex
+	archives   = make(map[string]*openedArchive)
+)
+
+// rootFS returns the read-only file system of a root_path: the directory
+// itself, or the contents of a .zip, .tar or .tar.gz archive. An archive is
+// indexed once and again when the file changes.
+func rootFS(rootPath string) (fs.FS, error) {
+	if !isArchive(rootPath) {
+		return os.DirFS(rootPath), nil
+	}
+	info, err := os.Stat(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	if archive := archives[rootPath]; archive != nil && archive.size == info.Size() && archive.modTime.Equal(info.ModTime()) {
+		return archive.fsys, nil
+	}
+
+	var fsys fs.FS
+	if strings.HasSuffix(strings.ToLower(rootPath), ".zip") {
+		fsys, err = zip.OpenReader(rootPath)
+	} else {
+		fsys, err = openTar(rootPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The zip reader of the previous version isn't closed, as requests may
+	// still be reading from it. Its file stays open until the reader is
+	// garbage collected, at the cost of a descriptor per change meanwhile.
+	archives[rootPath] = &openedArchive{fsys: fsys, size: info.Size(), modTime: info.ModTime()}
+	return fsys, nil
+}
+
+// tarFS is the index of a tar archive. Files of a plain tar are read from the
+// archive when they are opened; those of a compressed one are kept in memory
+// since it can't be read at an offset.
+type tarFS struct {
+	path       string
+	compressed bool
+	entries    map[string]*tarEntry // by name, "." being the top directory
+}
+
+// tarEntry is a file or directory of a tar archive
+type tarEntry struct {
+	name     string // base name
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	offset   int64  // of the contents in a plain tar
+	data     []byte // contents in a compressed tar
+	children map[string]*tarEntry
+	sorted   []fs.DirEntry // children by name
+}
+
+func (e *tarEntry) Name() string       { return e.name }
+func (e *tarEntry) Size() int64        { return e.size }
+func (e *tarEntry) Mode() fs.FileMode  { return e.mode }
+func (e *tarEntry) ModTime() time.Time { return e.modTime }
+func (e *tarEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *tarEntry) Sys() interface{}   { return nil }
+
+// countingReader tells the offset the tar reader reached in a plain tar
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openTar indexes the directories and regular files of a tar archive, gzip
+// compressed unless its name ends with .tar. Links and special files are
+// left out.
+func openTar(archivePath string) (*tarFS, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	t := &tarFS{
+		path:       archivePath,
+		compressed: !strings.HasSuffix(strings.ToLower(archivePath), ".tar"),
+		entries:    make(map[string]*tarEntry),
+	}
+	t.dir(".")
+	counter := &countingReader{r: file}
+	var r io.Reader = counter
+	if t.compressed {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == "." || !fs.ValidPath(name) {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			dir := t.dir(name)
+			dir.mode = fs.ModeDir | header.FileInfo().Mode().Perm()
+			dir.modTime = header.ModTime
+		case tar.TypeReg:
+			entry := &tarEntry{name: path.Base(name), mode: header.FileInfo().Mode().Perm(), size: header.Size, modTime: header.ModTime}
+			if t.compressed {
+				if entry.data, err = io.ReadAll(reader); err != nil {
+					return nil, err
+				}
+			} else {
+				entry.offset = counter.n
+			}
+			parent := t.dir(path.Dir(name))
+			if parent.children[entry.name] == nil || !parent.children[entry.name].IsDir() {
+				t.entries[name] = entry
+				parent.children[entry.name] = entry
+			}
+		}
+	}
+
+	for _, entry := range t.entries {
+		for _, child := range entry.children {
+			entry.sorted = append(entry.sorted, fs.FileInfoToDirEntry(child))
+		}
+		sort.Slice(entry.sorted, func(i, j int) bool { return entry.sorted[i].Name() < entry.sorted[j].Name() })
+	}
+	return t, nil
+}
+
+// dir returns the directory entry of name, adding it and its parents when
+// the archive doesn't list them
+func (t *tarFS) dir(name string) *tarEntry {
+	if entry := t.entries[name]; entry != nil && entry.IsDir() {
+		return entry
+	}
+	entry := &tarEntry{name: path.Base(name), mode: fs.ModeDir | 0555, children: make(map[string]*tarEntry)}
+	t.entries[name] = entry
+	if name != "." {
+		t.dir(path.Dir(name)).children[entry.name] = entry
+	}
+	return entry
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	entry, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsDir() {
+		return &tarDir{entry: entry}, nil
+	}
+	if t.compressed {
+		return &tarFile{entry: entry, Reader: bytes.NewReader(entry.data)}, nil
+	}
+	file, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	return &tarFile{entry: entry, Reader: io.NewSectionReader(file, entry.offset, entry.size), closer: file}, nil
+}
+
+// Stat doesn't open the archive
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	return t.lookup("stat", name)
+}
+
+func (t *tarFS) lookup(op string, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	entry := t.entries[name]
+	if entry == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+type tarFile struct {
+	entry *tarEntry
+	io.Reader
+	closer io.Closer // the archive, for a plain tar
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+
+func (f *tarFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+type tarDir struct {
+	entry *tarEntry
+	read  int // children already returned by ReadDir
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: fs.ErrInvalid}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entry.sorted[d.read:]
+	if n <= 0 {
+		d.read += len(remaining)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.read += n
+	return remaining[:n], nil
+}
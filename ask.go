@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Instructions sent before the prompt of /ask-context
+const askSystemPrompt = "You are an assistant answering questions about a software project from excerpts of its source code. " +
+	"Be concise and precise, cite every excerpt you rely on by its ID in square brackets, and never make up code that isn't in the excerpts."
+
+// Citations in an answer, as in [2] or [1, 3]
+var citationPattern = regexp.MustCompile(`\[([0-9]+(?:\s*,\s*[0-9]+)*)\]`)
+
+var chat *chatClient // nil unless chat_url is set
+
+// chatMessage is a message of a chat completion request
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatClient calls the /chat/completions endpoint of an OpenAI-compatible API,
+// such as a local llama.cpp or Ollama server
+type chatClient struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+// newChatClient returns the chat model configured in the settings, nil when
+// chat_url isn't set
+func newChatClient(settings GeneralSettings) *chatClient {
+	if settings.ChatURL == "" {
+		return nil
+	}
+	return &chatClient{
+		url:    chatEndpoint(settings.ChatURL),
+		model:  settings.ChatModel,
+		apiKey: settings.ChatAPIKey,
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// chatEndpoint accepts the base URL of the API, such as
+// http://localhost:11434/v1, or the full /chat/completions URL
+func chatEndpoint(baseURL string) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if strings.HasSuffix(baseURL, "/chat/completions") {
+		return baseURL
+	}
+	return baseURL + "/chat/completions"
+}
+
+// complete asks the model to answer the messages, calling onDelta with each
+// piece of the answer as it is generated. A server that doesn't stream
+// answers in a single piece.
+func (c *chatClient) complete(ctx context.Context, messages []chatMessage, onDelta func(string) error) error {
+	body, err := json.Marshal(map[string]interface{}{"model": c.model, "messages": messages, "stream": true})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "text/event-stream")
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("chat server: %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		var result struct {
+			Choices []struct {
+				Message chatMessage `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+			return err
+		}
+		if len(result.Choices) == 0 {
+			return errors.New("chat server returned no answer")
+		}
+		return onDelta(result.Choices[0].Message.Content)
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // comments, event names and blank separators
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta chatMessage `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("chat server: %v", err)
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			if err := onDelta(chunk.Choices[0].Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// citedIn returns the citations an answer refers to, in the order of their
+// IDs
+func citedIn(answer string, citations []citation) []citation {
+	cited := make(map[int]bool)
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, id := range strings.Split(match[1], ",") {
+			if n, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+				cited[n] = true
+			}
+		}
+	}
+	result := []citation{}
+	for _, c := range citations {
+		if cited[c.ID] {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// askHandler answers the question ?q= with the configured chat model, from
+// the context /ask-context would assemble. The answer is streamed as server
+// sent events: "context" with the citations given to the model, "answer"
+// with each piece of the answer, then "done" with the whole answer and the
+// citations it refers to, or "error". With ?stream=false, the answer comes
+// at once as JSON. The excerpts come from the semantic index, so their
+// secrets are masked before they reach the chat server.
+func askHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+	// Every question costs a call to the chat model, so it's for the local
+	// network unless ask_external_clients is set
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !generalSettings.AskExternalClients && !isLocalIP(ip) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if chat == nil {
+		http.Error(w, "No chat model configured, set chat_url and chat_model in settings.json", http.StatusNotImplemented)
+		return
+	}
+
+	question := strings.TrimSpace(r.URL.Query().Get("q"))
+	if question == "" {
+		http.Error(w, "Missing question, use ?q=", http.StatusBadRequest)
+		return
+	}
+	budget, err := parseTokenBudget(r.URL.Query().Get("budget"), askContextDefaultBudget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stream := r.URL.Query().Get("stream") != "false"
+
+	config := configs[project+".json"]
+	context, err := assembleContext(project, config, question, budget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages := []chatMessage{{Role: "system", Content: askSystemPrompt}, {Role: "user", Content: context.Prompt}}
+
+	type answer struct {
+		Project   string     `json:"project"`
+		Question  string     `json:"question"`
+		Answer    string     `json:"answer"`
+		Citations []citation `json:"citations"`
+	}
+
+	if !stream {
+		var text strings.Builder
+		err := chat.complete(r.Context(), messages, func(delta string) error {
+			text.WriteString(delta)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(answer{project, question, text.String(), citedIn(text.String(), context.Citations)})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported, use ?stream=false", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // for nginx in front
+	sendEvent := func(event string, data interface{}) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	sendEvent("context", context.Citations)
+	var text strings.Builder
+	err = chat.complete(r.Context(), messages, func(delta string) error {
+		text.WriteString(delta)
+		return sendEvent("answer", map[string]string{"content": delta})
+	})
+	if err != nil {
+		sendEvent("error", map[string]string{"error": err.Error()})
+		return
+	}
+	sendEvent("done", answer{project, question, text.String(), citedIn(text.String(), context.Citations)})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Token budget of the excerpts of /ask-context when ?budget= isn't given
+const askContextDefaultBudget = 8000
+
+// Chunks retrieved for a question, before the budget picks among them
+const askContextCandidates = 40
+
+// citation is an excerpt of the context assembled for a question
+type citation struct {
+	ID        int    `json:"id"`
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	URL       string `json:"url"` // of the lines on /f
+	content   string
+}
+
+// askContext is what a model needs to answer a question about a project
+type askContext struct {
+	Project   string     `json:"project"`
+	Question  string     `json:"question"`
+	Tokens    int        `json:"tokens"` // estimated, of the excerpts
+	Prompt    string     `json:"prompt"`
+	Citations []citation `json:"citations"`
+}
+
+// assembleContext retrieves the chunks that best answer the question, most
+// relevant first as long as they fit in budget tokens, and merges those that
+// overlap or follow each other into excerpts. The excerpts are ordered by
+// path and line, and numbered so an answer can cite them.
+func assembleContext(project string, config Config, question string, budget int) (askContext, error) {
+	results, err := retrieve(project, config, question, askContextCandidates)
+	if err != nil {
+		return askContext{}, err
+	}
+
+	selected := make(map[string]map[int]string) // lines kept, by file and line number
+	used := 0
+	for _, result := range results {
+		lines := strings.SplitAfter(result.Text, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		fileLines := selected[result.Path]
+		var added strings.Builder
+		for i, line := range lines {
+			if _, ok := fileLines[result.StartLine+i]; !ok {
+				added.WriteString(line)
+			}
+		}
+		if added.Len() == 0 {
+			continue // already covered by better chunks
+		}
+		tokens := estimateTokens([]byte(added.String()))
+		if used+tokens > budget {
+			continue // a smaller chunk may still fit
+		}
+		used += tokens
+		if fileLines == nil {
+			fileLines = make(map[int]string)
+			selected[result.Path] = fileLines
+		}
+		for i, line := range lines {
+			fileLines[result.StartLine+i] = line
+		}
+	}
+
+	paths := make([]string, 0, len(selected))
+	for path := range selected {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	context := askContext{Project: project, Question: question, Tokens: used, Citations: []citation{}}
+	for _, path := range paths {
+		numbers := make([]int, 0, len(selected[path]))
+		for number := range selected[path] {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		for start := 0; start < len(numbers); {
+			end := start
+			var content strings.Builder
+			for end < len(numbers) && numbers[end] == numbers[start]+end-start {
+				content.WriteString(selected[path][numbers[end]])
+				end++
+			}
+			startLine, endLine := numbers[start], numbers[end-1]
+			context.Citations = append(context.Citations, citation{
+				ID:        len(context.Citations) + 1,
+				Path:      path,
+				StartLine: startLine,
+				EndLine:   endLine,
+				URL:       fmt.Sprintf("%s/f/%s%s?lines=%d-%d", config.ProjectURL, project, escapePath(path), startLine, endLine),
+				content:   content.String(),
+			})
+			start = end
+		}
+	}
+	context.Prompt = buildContextPrompt(config, question, context.Citations)
+	return context, nil
+}
+
+// escapePath escapes each segment of a path for a URL, keeping its slashes
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// buildContextPrompt writes the question and the excerpts as a markdown
+// prompt, each excerpt under its citation ID
+func buildContextPrompt(config Config, question string, citations []citation) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Answer the question below using the excerpts of the source code of %s that follow it. Cite the excerpts you rely on by their ID, as in [1], and say so when they don't contain the answer.\n\n", config.ProjectName)
+	fmt.Fprintf(&b, "## Question\n\n%s\n\n## Excerpts\n\n", question)
+	if len(citations) == 0 {
+		b.WriteString("No part of the project matches the question.\n")
+	}
+	for _, c := range citations {
+		fence := markdownFence(c.content)
+		fmt.Fprintf(&b, "### [%d] %s (lines %d-%d)\n\nSource: %s\n\n%s%s\n%s", c.ID, c.Path, c.StartLine, c.EndLine, c.URL, fence, markdownLanguage(c.Path), c.content)
+		if !strings.HasSuffix(c.content, "\n") {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s\n\n", fence)
+	}
+	return b.String()
+}
+
+// askContextHandler serves the prompt assembled for the question ?q=, as
+// text, or as JSON with its citations when ?format=json
+func askContextHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	question := strings.TrimSpace(r.URL.Query().Get("q"))
+	if question == "" {
+		http.Error(w, "Missing question, use ?q=", http.StatusBadRequest)
+		return
+	}
+	budget, err := parseTokenBudget(r.URL.Query().Get("budget"), askContextDefaultBudget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != formatText && format != formatJSON {
+		http.Error(w, "Invalid format, expected text or json", http.StatusBadRequest)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	context, err := assembleContext(project, selectedConfig, question, budget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == formatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(context)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Write([]byte(context.Prompt))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Baskets are appended to this file next to settings.json, one JSON object
+// per line, so their URLs outlive a restart
+const basketsFile = "baskets.jsonl"
+
+// Most paths a basket can hold
+const maxBasketPaths = 1000
+
+// Most baskets kept, the oldest being dropped to make room for a new one
+const maxBaskets = 10000
+
+// Most baskets a client can create per minute
+const maxBasketsPerMinute = 30
+
+// basket is a set of files and directories picked in the tree view, shared
+// as one URL
+type basket struct {
+	Project string    `json:"project"`
+	Paths   []string  `json:"paths"`
+	Created time.Time `json:"created"`
+}
+
+// basketRecord is a line of the baskets file
+type basketRecord struct {
+	ID string `json:"id"`
+	basket
+}
+
+type basketStore struct {
+	mu      sync.Mutex
+	file    string
+	baskets map[string]basket // by ID
+	order   []string          // IDs, oldest first
+	records int               // lines of the file, dropped baskets included
+}
+
+var baskets *basketStore
+
+// loadBaskets reads the baskets saved in file, if any. As the oldest baskets
+// are dropped first, keeping the newest maxBaskets gives back the baskets
+// kept before the restart. A line cut short by a crash is skipped.
+func loadBaskets(file string) (*basketStore, error) {
+	s := &basketStore{file: file, baskets: make(map[string]basket)}
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record basketRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		s.records++
+		s.baskets[record.ID] = record.basket
+	}
+	for id := range s.baskets {
+		s.order = append(s.order, id)
+	}
+	sort.Slice(s.order, func(i, j int) bool {
+		return s.baskets[s.order[i]].Created.Before(s.baskets[s.order[j]].Created)
+	})
+	s.dropOldest(maxBaskets)
+	return s, scanner.Err()
+}
+
+// dropOldest drops the oldest baskets until at most n are left
+func (s *basketStore) dropOldest(n int) {
+	for len(s.order) > n {
+		delete(s.baskets, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// basketID derives the ID of a basket from the project and the paths, so
+// picking the same files again gives the same URL. attempt is raised when
+// the ID is taken by another basket.
+func basketID(project string, paths []string, attempt int) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", project)
+	for _, path := range paths {
+		fmt.Fprintf(hash, "%s\n", path)
+	}
+	if attempt > 0 {
+		fmt.Fprintf(hash, "%d\n", attempt)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:10]
+}
+
+// add stores a basket and returns its ID. When there are maxBaskets
+// already, the oldest is dropped.
+func (s *basketStore) add(project string, paths []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var id string
+	for attempt := 0; ; attempt++ {
+		id = basketID(project, paths, attempt)
+		existing, ok := s.baskets[id]
+		if !ok {
+			break
+		}
+		if existing.Project == project && slices.Equal(existing.Paths, paths) {
+			return id, nil
+		}
+	}
+
+	s.dropOldest(maxBaskets - 1)
+	b := basket{Project: project, Paths: paths, Created: time.Now().UTC()}
+	s.baskets[id] = b
+	s.order = append(s.order, id)
+
+	// Once most lines are of dropped baskets, the file is written anew
+	if s.records >= 2*maxBaskets {
+		return id, s.compact()
+	}
+	line, err := json.Marshal(basketRecord{ID: id, basket: b})
+	if err != nil {
+		return id, err
+	}
+	f, err := os.OpenFile(s.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return id, err
+	}
+	defer f.Close()
+	s.records++
+	_, err = f.Write(append(line, '\n'))
+	return id, err
+}
+
+// compact writes the kept baskets to the file, oldest first
+func (s *basketStore) compact() error {
+	var data []byte
+	for _, id := range s.order {
+		line, err := json.Marshal(basketRecord{ID: id, basket: s.baskets[id]})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	// Write to a temporary file first, so a crash can't leave half a file
+	if err := os.WriteFile(s.file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(s.file+".tmp", s.file); err != nil {
+		return err
+	}
+	s.records = len(s.order)
+	return nil
+}
+
+// basketLimiter counts the baskets created by each client in the current
+// minute
+type basketLimiter struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int // by IP
+}
+
+var basketLimits = &basketLimiter{}
+
+// allow tells whether the client at ip can create another basket this minute
+func (l *basketLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.start) >= time.Minute {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[ip] >= maxBasketsPerMinute {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+func (s *basketStore) get(id string) (basket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.baskets[id]
+	return b, ok
+}
+
+// cleanBasketPaths checks that every path exists in the project and returns
+// them with a leading slash, sorted and without duplicates
+func cleanBasketPaths(config Config, paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths selected")
+	}
+	if len(paths) > maxBasketPaths {
+		return nil, fmt.Errorf("a basket holds at most %d paths", maxBasketPaths)
+	}
+	seen := make(map[string]bool)
+	var cleaned []string
+	for _, path := range paths {
+		path = "/" + strings.Trim(filepath.ToSlash(path), "/")
+		root, name, err := resolvePath(config, path)
+		if err == nil && root != nil {
+			_, err = fs.Stat(root.FS, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if !seen[path] {
+			seen[path] = true
+			cleaned = append(cleaned, path)
+		}
+	}
+	sort.Strings(cleaned)
+	return cleaned, nil
+}
+
+// createBasketHandler stores the paths posted as {"paths": [...]} and answers
+// with the basket's URLs
+func createBasketHandler(w http.ResponseWriter, r *http.Request) {
+	// Baskets are made from the tree view, which has the same restriction
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if generalSettings.DisableExternalNetworkBrowsing && !isLocalIP(ip) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if !basketLimits.allow(ip) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many baskets, try again in a minute", http.StatusTooManyRequests)
+		return
+	}
+
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	config := configs[project+".json"]
+	paths, err := cleanBasketPaths(config, request.Paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := baskets.add(project, paths)
+	if err != nil {
+		// The basket still works until the server restarts
+		fmt.Println("Error saving baskets:", err)
+	}
+	url := fmt.Sprintf("/b/%s/%s", project, id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":           id,
+		"paths":        paths,
+		"url":          url,
+		"external_url": config.ProjectURL + url,
+	})
+}
+
+// basketHandler serves the files of a basket in the format of /c
+func basketHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+	id := vars["id"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	b, ok := baskets.get(id)
+	if !ok || b.Project != project {
+		http.Error(w, "Unknown basket", http.StatusNotFound)
+		return
+	}
+
+	format, err := parseContentsFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	files, err := collectPathsContents(selectedConfig, b.Paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if shouldRedact(r) {
+		redactContents(selectedConfig, files)
+	}
+
+	skipped := 0
+	for _, file := range files {
+		if file.Skipped != "" {
+			skipped++
+		}
+	}
+	w.Header().Set("Content-Type", contentsContentType(format))
+	w.Header().Set("X-Skipped-Files", strconv.Itoa(skipped))
+	w.Write([]byte(formatContents(files, format)))
+}
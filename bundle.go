@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// A line range at the end of a bundle path, as in "main.go:10-80" or
+// "main.go:120-" up to the end of the file
+var bundleRangePattern = regexp.MustCompile(`^(.*):([0-9]+-[0-9]*)$`)
+
+var lineRangePattern = regexp.MustCompile(`^([0-9]+)-([0-9]*)$`)
+
+// parseLineRange reads a range of lines such as 10-80, or 120- up to the end
+// of the file, as in bundle paths and /f?lines=. The end is 0 when open.
+func parseLineRange(value string) (int, int, error) {
+	match := lineRangePattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, 0, fmt.Errorf("invalid line range %q", value)
+	}
+	startLine, _ := strconv.Atoi(match[1])
+	endLine := 0
+	if match[2] != "" {
+		endLine, _ = strconv.Atoi(match[2])
+	}
+	if startLine < 1 || (endLine != 0 && endLine < startLine) {
+		return 0, 0, fmt.Errorf("invalid line range %q", value)
+	}
+	return startLine, endLine, nil
+}
+
+// errDirectoryRange is returned for a bundle path naming a directory with a
+// line range
+var errDirectoryRange = errors.New("a line range only applies to a file")
+
+// bundleEntry is a path of a bundle with its line range split off
+type bundleEntry struct {
+	Path      string // slash separated, without leading slash
+	StartLine int    // 0 for the whole file
+	EndLine   int    // 0 for up to the end of the file
+}
+
+// parseBundleEntry splits the line range off a bundle path
+func parseBundleEntry(entry string) (bundleEntry, error) {
+	parsed := bundleEntry{Path: entry}
+	if match := bundleRangePattern.FindStringSubmatch(entry); match != nil {
+		parsed.Path = match[1]
+		var err error
+		if parsed.StartLine, parsed.EndLine, err = parseLineRange(match[2]); err != nil {
+			return parsed, fmt.Errorf("invalid line range in %q", entry)
+		}
+	}
+	parsed.Path = strings.Trim(filepath.ToSlash(parsed.Path), "/")
+	if isGlob(parsed.Path) {
+		for _, segment := range strings.Split(parsed.Path, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return parsed, fmt.Errorf("invalid glob %q: %v", parsed.Path, err)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// matchGlob matches a slash separated path against a pattern in which * and ?
+// stay within a directory and ** matches any number of directories
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// findBundle returns the bundle of a project with the given name
+func findBundle(config Config, name string) (BundleConfig, bool) {
+	for _, bundle := range config.Bundles {
+		if bundle.Name == name {
+			return bundle, true
+		}
+	}
+	return BundleConfig{}, false
+}
+
+// collectBundleContents reads the files of a bundle in the order its paths
+// are listed. Globs match the files /c would include, in directory order. A
+// file listed twice with the same line range is only included once, and a
+// path that doesn't exist is reported as skipped. A directory with a line
+// range is an error. With redact, the secrets of each file are masked before
+// it is cut to its line range, so a range can't start inside a private key.
+func collectBundleContents(config Config, bundle BundleConfig, redact bool) ([]contentFile, error) {
+	files := []contentFile{}
+	seen := make(map[string]bool)
+	add := func(file contentFile, startLine, endLine int) {
+		if redact && file.Skipped == "" {
+			file.Content, _ = redactText(config, file.Path, file.Content)
+		}
+		file = sliceLines(file, startLine, endLine)
+		if !seen[file.label()] {
+			seen[file.label()] = true
+			files = append(files, file)
+		}
+	}
+
+	for _, item := range bundle.Paths {
+		entry, err := parseBundleEntry(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if isGlob(entry.Path) {
+			err := walkProjectFiles(config, "", func(root *projectRoot, name, fileRelativePath string, _ fs.DirEntry) error {
+				if !matchGlob(entry.Path, fileRelativePath) {
+					return nil
+				}
+				file, err := readContentFile(root, name, fileRelativePath)
+				if err != nil {
+					return err
+				}
+				add(file, entry.StartLine, entry.EndLine)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		root, name, err := resolvePath(config, entry.Path)
+		var info fs.FileInfo
+		if err == nil && root != nil {
+			info, err = fs.Stat(root.FS, name)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			add(contentFile{Path: "/" + entry.Path, Skipped: "no longer exists"}, 0, 0)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if root == nil || info.IsDir() {
+			if entry.StartLine != 0 {
+				return nil, fmt.Errorf("%q is a directory, %w", item, errDirectoryRange)
+			}
+			dirFiles, err := collectDirContents(config, entry.Path)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range dirFiles {
+				add(file, 0, 0)
+			}
+			continue
+		}
+		file, err := readContentFile(root, name, entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		add(file, entry.StartLine, entry.EndLine)
+	}
+	return files, nil
+}
+
+// sliceLines keeps the lines startLine to endLine of a file, counting from 1,
+// endLine 0 meaning the last line. A startLine of 0 keeps the whole file.
+func sliceLines(file contentFile, startLine, endLine int) contentFile {
+	if startLine == 0 || file.Skipped != "" {
+		return file
+	}
+	lines := strings.SplitAfter(file.Content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if endLine == 0 || endLine > len(lines) {
+		endLine = len(lines)
+	}
+	if startLine > endLine {
+		return contentFile{Path: file.Path, Skipped: fmt.Sprintf("line %d is past the end of the file (%d lines)", startLine, len(lines))}
+	}
+	content := strings.Join(lines[startLine-1:endLine], "")
+	return contentFile{
+		Path:      file.Path,
+		Size:      len(content),
+		Lines:     endLine - startLine + 1,
+		Content:   content,
+		StartLine: startLine,
+		EndLine:   endLine,
+	}
+}
+
+// bundleLinks lists the bundles of a project on its page
+func bundleLinks(config Config, project string) string {
+	if len(config.Bundles) == 0 {
+		return ""
+	}
+	var links strings.Builder
+	links.WriteString("<div class=\"bundle-list\">\n")
+	for _, bundle := range config.Bundles {
+		link := fmt.Sprintf("/bundle/%s/%s", project, url.PathEscape(bundle.Name))
+		description := html.EscapeString(bundle.Description)
+		if description == "" {
+			description = "Display bundle file content"
+		}
+		fmt.Fprintf(&links, `    <span class="bundle"><a href='%s' target='_blank' title="%s"><i class='fas fa-layer-group' style='color:#9370DB'></i> %s</a>
+    <button class='copy-button' data-url='%s' title="Copy bundle URL"><i class='fas fa-copy' style='color:green'></i></button></span>
+`, link, description, html.EscapeString(bundle.Name), config.ProjectURL+link)
+	}
+	links.WriteString("</div>\n")
+	return links.String()
+}
+
+// bundleHandler serves the files of a bundle of the project in the format
+// of /c
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+	name := vars["name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	bundle, ok := findBundle(selectedConfig, name)
+	if !ok {
+		http.Error(w, "Unknown bundle", http.StatusNotFound)
+		return
+	}
+
+	format, err := parseContentsFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files, err := collectBundleContents(selectedConfig, bundle, shouldRedact(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	skipped := 0
+	for _, file := range files {
+		if file.Skipped != "" {
+			skipped++
+		}
+	}
+	w.Header().Set("Content-Type", contentsContentType(format))
+	w.Header().Set("X-Skipped-Files", strconv.Itoa(skipped))
+	w.Write([]byte(formatContents(files, format)))
+}
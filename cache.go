@@ -0,0 +1,320 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// contentCache keeps directory listings and text file contents of the
+// projects in memory. Entries are evicted least recently used first once
+// maxBytes is reached. A filesystem watcher invalidates them when files
+// change; file contents are also keyed by modification time and size, so a
+// file in a directory that couldn't be watched is checked with a stat.
+type contentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	// Bumped on every invalidation, so a read that raced with a change
+	// isn't stored
+	generation uint64
+	used       int64
+	lru        *list.List               // of *cacheEntry, most recently used first
+	entries    map[string]*list.Element // by cache key
+	watcher    *fsnotify.Watcher
+	watched    map[string]bool // directories being watched
+	roots      []watchedRoot
+}
+
+// A project root being watched, with the filter telling which of its new
+// directories to watch
+type watchedRoot struct {
+	path   string
+	filter fileFilter
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+
+	// Set for a directory listing
+	dirEntries []fs.DirEntry
+
+	// Set for a file
+	data    []byte // nil when the file is binary
+	binary  bool
+	modTime time.Time
+	fileLen int64
+}
+
+// Cache keys are prefixed so a directory and a file never share one
+const (
+	dirKeyPrefix  = "d:"
+	fileKeyPrefix = "f:"
+)
+
+// The cache shared by all handlers, nil when cache_max_bytes is 0
+var cache *contentCache
+
+// newContentCache creates a cache and starts watching the project roots. If
+// the watcher can't be created, directory listings aren't cached and file
+// contents are validated with a stat on every lookup.
+func newContentCache(maxBytes int64, projects map[string]Config) *contentCache {
+	c := &contentCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		watched:  make(map[string]bool),
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Println("File watcher unavailable, caching with stat checks only:", err)
+		return c
+	}
+	c.watcher = watcher
+	for _, config := range projects {
+		roots, err := projectRoots(config)
+		if err != nil {
+			fmt.Println("Cannot watch", config.ProjectName+":", err)
+			continue
+		}
+		for _, projectRoot := range roots {
+			if isArchive(projectRoot.Path) {
+				continue // Indexed again when the archive changes
+			}
+			root := watchedRoot{path: filepath.Clean(projectRoot.Path), filter: projectRoot.Filter}
+			c.roots = append(c.roots, root)
+			c.watchTree(root, root.path)
+		}
+	}
+	go c.watch()
+	return c
+}
+
+// watchTree adds a watch on dir and on every directory below it that the
+// root's filter doesn't exclude
+func (c *contentCache) watchTree(root watchedRoot, dir string) {
+	relativePath, err := filepath.Rel(root.path, dir)
+	if err != nil {
+		return
+	}
+	if relativePath != "." {
+		// Paths of a named root are prefixed with its name in the project
+		projectPath := path.Join(root.filter.Prefix, filepath.ToSlash(relativePath))
+		if root.filter.skipHidden(filepath.Base(dir)) || root.filter.excludeDir(projectPath, filepath.Base(dir)) {
+			return
+		}
+	}
+	if err := c.watcher.Add(dir); err != nil {
+		fmt.Println("Cannot watch", dir+":", err)
+		return
+	}
+	c.mu.Lock()
+	c.watched[dir] = true
+	c.mu.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			c.watchTree(root, filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// watch invalidates entries as filesystem events arrive
+func (c *contentCache) watch() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			path := filepath.Clean(event.Name)
+			c.invalidate(path, event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename))
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					for _, root := range c.roots {
+						if strings.HasPrefix(path, root.path+string(filepath.Separator)) {
+							c.watchTree(root, path)
+						}
+					}
+				}
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, so nothing cached can be trusted
+			fmt.Println("File watcher error, clearing cache:", err)
+			c.clear()
+		}
+	}
+}
+
+// invalidate drops a changed path and the listing of its parent directory.
+// A removed directory also takes everything below it.
+func (c *contentCache) invalidate(path string, removed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.remove(fileKeyPrefix + path)
+	c.remove(dirKeyPrefix + path)
+	c.remove(dirKeyPrefix + filepath.Dir(path))
+	if removed {
+		prefix := path + string(filepath.Separator)
+		for key := range c.entries {
+			// Both key prefixes have the same length
+			if strings.HasPrefix(key[len(fileKeyPrefix):], prefix) {
+				c.remove(key)
+			}
+		}
+		for dir := range c.watched {
+			if dir == path || strings.HasPrefix(dir, prefix) {
+				delete(c.watched, dir)
+			}
+		}
+	}
+}
+
+func (c *contentCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.used = 0
+}
+
+// remove drops an entry, the lock being held
+func (c *contentCache) remove(key string) {
+	if element, ok := c.entries[key]; ok {
+		c.used -= element.Value.(*cacheEntry).size
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// get returns an entry and marks it as recently used, the lock being held
+func (c *contentCache) get(key string) *cacheEntry {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+// put stores an entry and evicts the least recently used ones over the cap,
+// the lock being held
+func (c *contentCache) put(entry *cacheEntry) {
+	if entry.size > c.maxBytes/4 {
+		return // Don't let a single entry flush most of the cache
+	}
+	c.remove(entry.key)
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.used += entry.size
+	for c.used > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// readDir returns the entries of the directory name of fsys sorted by name,
+// like fs.ReadDir, served from the cache when the directory is watched. dir is
+// where it is on disk. The entries' Info doesn't touch the filesystem again.
+func (c *contentCache) readDir(fsys fs.FS, name string, dir string) ([]fs.DirEntry, error) {
+	if c == nil {
+		return fs.ReadDir(fsys, name)
+	}
+	dir = filepath.Clean(dir)
+	key := dirKeyPrefix + dir
+
+	c.mu.Lock()
+	if entry := c.get(key); entry != nil {
+		c.mu.Unlock()
+		return entry.dirEntries, nil
+	}
+	watched := c.watched[dir]
+	generation := c.generation
+	c.mu.Unlock()
+
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil || !watched {
+		return entries, err
+	}
+	size := int64(64)
+	snapshot := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return entries, nil // Changed while reading, don't cache it
+		}
+		snapshot = append(snapshot, fs.FileInfoToDirEntry(info))
+		size += int64(len(entry.Name())) + 128
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.put(&cacheEntry{key: key, size: size, dirEntries: snapshot})
+	}
+	c.mu.Unlock()
+	return snapshot, nil
+}
+
+// lookupFile returns the cached text file name of fsys, which is at path on
+// disk, if it is still current. On a miss, the returned generation is to be
+// passed to storeFile.
+func (c *contentCache) lookupFile(fsys fs.FS, name string, path string) (*cacheEntry, uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	path = filepath.Clean(path)
+
+	c.mu.Lock()
+	entry := c.get(fileKeyPrefix + path)
+	watched := c.watched[filepath.Dir(path)]
+	generation := c.generation
+	c.mu.Unlock()
+	if entry == nil || watched {
+		return entry, generation
+	}
+
+	// Without a watcher the entry is only good for the same mtime and size
+	info, err := fs.Stat(fsys, name)
+	if err != nil || !info.ModTime().Equal(entry.modTime) || info.Size() != entry.fileLen {
+		return nil, generation
+	}
+	return entry, generation
+}
+
+// storeFile caches a file read from disk, unless something changed since
+// the lookup that returned generation
+func (c *contentCache) storeFile(path string, generation uint64, info fs.FileInfo, data []byte, binary bool) {
+	if c == nil {
+		return
+	}
+	entry := &cacheEntry{
+		key:     fileKeyPrefix + filepath.Clean(path),
+		size:    int64(len(data)) + 128,
+		data:    data,
+		binary:  binary,
+		modTime: info.ModTime(),
+		fileLen: info.Size(),
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.put(entry)
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported content codings, in order of preference when the client accepts
+// several with the same quality
+var compressionEncodings = []string{"zstd", "br", "gzip"}
+
+// Encoders are reused across responses, one pool per coding
+var encoderPools = map[string]*sync.Pool{
+	"zstd": {New: func() interface{} {
+		// Browsers only decode windows up to 8 MB
+		encoder, _ := zstd.NewWriter(nil, zstd.WithWindowSize(8<<20), zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// A pooled encoder that can be pointed at a new response
+type resettableEncoder interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressHandler compresses the responses of next with the best coding the
+// client accepts, once a response reaches minSize bytes. Smaller responses,
+// responses that aren't text, and streamed events are sent as they are.
+func compressHandler(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the supported coding with the highest quality in an
+// Accept-Encoding header, or "" for no compression
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range compressionEncodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// isCompressible reports whether a content type is worth compressing
+func isCompressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "text/event-stream" {
+		return false // Events have to reach the client as they are flushed
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		mediaType == "application/javascript"
+}
+
+// compressResponseWriter buffers the start of a response until it knows
+// whether it is large enough to compress
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool // headers sent, buf flushed
+	encoder resettableEncoder
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.started || cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// Nothing to compress in these, and a handler that already encoded its
+	// response knows better
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		cw.Header().Get("Content-Encoding") != "" {
+		cw.start(false)
+	}
+}
+
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.started {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers and what was buffered, compressing from then on
+// if compress is set and the content type allows it
+func (cw *compressResponseWriter) start(compress bool) error {
+	cw.started = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	compressible := isCompressible(header.Get("Content-Type")) && header.Get("Content-Encoding") == ""
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if compress && compressible {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		// The compressed bytes differ, so the entity tag can only be weak
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		cw.encoder = encoderPools[cw.encoding].Get().(resettableEncoder)
+		cw.encoder.Reset(cw.ResponseWriter)
+	}
+
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// Flush sends what was buffered uncompressed if compression hasn't started,
+// so streamed responses aren't held back
+func (cw *compressResponseWriter) Flush() {
+	if !cw.started {
+		cw.start(false)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the response and returns the encoder to its pool
+func (cw *compressResponseWriter) Close() {
+	if !cw.started {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return // The handler wrote nothing, let net/http answer
+		}
+		cw.start(false)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+		cw.encoder.Reset(nil)
+		encoderPools[cw.encoding].Put(cw.encoder)
+		cw.encoder = nil
+	}
+}
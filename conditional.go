@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileETag derives an entity tag from the size and modification time of a file
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
+
+// treeETag walks the filtered tree of the project under relativePath without
+// reading any file and returns an entity tag hashed from the path, size and
+// modification time of every entry, along with the latest modification time.
+// variant is mixed in so different representations of the same tree get
+// different tags.
+func treeETag(config Config, relativePath, variant string) (string, time.Time, error) {
+	hash := sha256.New()
+	var lastModified time.Time
+	fmt.Fprintf(hash, "%s\n", variant)
+
+	track := func(info os.FileInfo) {
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+	}
+
+	// The directory itself changes when entries are added or removed
+	if root, name, err := resolvePath(config, relativePath); err == nil && root != nil {
+		if info, err := fs.Stat(root.FS, name); err == nil {
+			track(info)
+		}
+	}
+	err := walkProject(config, relativePath, func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		track(info)
+		fmt.Fprintf(hash, "%s\t%t\t%d\t%d\n", fileRelativePath, entry.IsDir(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return "\"" + hex.EncodeToString(hash.Sum(nil)[:16]) + "\"", lastModified, nil
+}
+
+// checkNotModified sets the ETag and Last-Modified headers and answers 304 Not
+// Modified when the request's If-None-Match or If-Modified-Since conditions
+// show the client already has this version. It returns true if it did.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil || lastModified.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	// A 304 carries no body, so drop the entity headers
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches applies the weak comparison of an If-None-Match list
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
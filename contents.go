@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// The output formats of the contents dump, selected with ?format=
+const (
+	formatText     = "text"
+	formatMarkdown = "markdown"
+	formatXML      = "xml"
+	formatJSON     = "json"
+)
+
+// contentFile is a file included in a contents dump
+type contentFile struct {
+	Path    string `json:"path"`
+	Size    int    `json:"size"`
+	Lines   int    `json:"lines"`
+	Content string `json:"content"`
+	Skipped string `json:"skipped,omitempty"` // why the content was left out
+	// Set when only part of the file is included, counting from 1
+	StartLine int `json:"start_line,omitempty"`
+	EndLine   int `json:"end_line,omitempty"`
+}
+
+// label is the path shown in the headers, with the line range if any
+func (f contentFile) label() string {
+	if f.StartLine == 0 {
+		return f.Path
+	}
+	return fmt.Sprintf("%s (lines %d-%d)", f.Path, f.StartLine, f.EndLine)
+}
+
+// parseContentsFormat validates a ?format= value, an empty one meaning text
+func parseContentsFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return formatText, nil
+	case formatText, formatMarkdown, formatXML, formatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("Invalid format %q, expected text, markdown, xml or json", format)
+}
+
+// contentsContentType returns the Content-Type header of a format
+func contentsContentType(format string) string {
+	switch format {
+	case formatMarkdown:
+		return "text/markdown; charset=UTF-8"
+	case formatXML:
+		return "application/xml; charset=UTF-8"
+	case formatJSON:
+		return "application/json"
+	}
+	return "text/plain; charset=UTF-8"
+}
+
+// collectDirContents reads every file of the project under relativePath that
+// passes the filter of its root. Binary and oversized files are kept with the
+// reason they were skipped.
+func collectDirContents(config Config, relativePath string) ([]contentFile, error) {
+	files := []contentFile{}
+	err := walkProjectFiles(config, relativePath, func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		file, err := readContentFile(root, name, fileRelativePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// collectPathsContents is collectDirContents for a list of files and
+// directories, each file being read once. A path that no longer exists is
+// kept as skipped.
+func collectPathsContents(config Config, paths []string) ([]contentFile, error) {
+	files := []contentFile{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		path = strings.Trim(filepath.ToSlash(path), "/")
+		root, name, err := resolvePath(config, path)
+		var info fs.FileInfo
+		if err == nil && root != nil {
+			info, err = fs.Stat(root.FS, name)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			files = append(files, contentFile{Path: "/" + path, Skipped: "no longer exists"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var pathFiles []contentFile
+		if root == nil || info.IsDir() {
+			pathFiles, err = collectDirContents(config, path)
+		} else {
+			var file contentFile
+			file, err = readContentFile(root, name, path)
+			pathFiles = []contentFile{file}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range pathFiles {
+			if !seen[file.Path] {
+				seen[file.Path] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// readContentFile reads one file of a contents dump
+func readContentFile(root *projectRoot, name, fileRelativePath string) (contentFile, error) {
+	fileData, skipped, err := root.readTextFile(name)
+	if err != nil {
+		return contentFile{}, err
+	}
+	if skipped != "" {
+		return contentFile{Path: "/" + fileRelativePath, Skipped: skipped}, nil
+	}
+	return contentFile{
+		Path:    "/" + fileRelativePath,
+		Size:    len(fileData),
+		Lines:   countLines(fileData),
+		Content: string(fileData),
+	}, nil
+}
+
+// formatContents renders the files of a contents dump in the given format.
+// Skipped files are listed in a footer, or flagged in the JSON array.
+func formatContents(files []contentFile, format string) string {
+	var contents strings.Builder
+	var skipped []contentFile
+	for _, file := range files {
+		if file.Skipped != "" {
+			skipped = append(skipped, file)
+		}
+	}
+
+	switch format {
+	case formatMarkdown:
+		for _, file := range files {
+			if file.Skipped != "" {
+				continue
+			}
+			fence := markdownFence(file.Content)
+			fmt.Fprintf(&contents, "## %s\n\n%s%s\n%s", file.label(), fence, markdownLanguage(file.Path), file.Content)
+			if !strings.HasSuffix(file.Content, "\n") {
+				contents.WriteString("\n")
+			}
+			fmt.Fprintf(&contents, "%s\n\n", fence)
+		}
+		if len(skipped) > 0 {
+			contents.WriteString("## Skipped files\n\n")
+			for _, file := range skipped {
+				fmt.Fprintf(&contents, "- `%s`: %s\n", file.Path, file.Skipped)
+			}
+		}
+	case formatXML:
+		contents.WriteString("<documents>\n")
+		for _, file := range files {
+			if file.Skipped != "" {
+				contents.WriteString("<skipped path=\"")
+				xml.EscapeText(&contents, []byte(file.Path))
+				contents.WriteString("\" reason=\"")
+				xml.EscapeText(&contents, []byte(file.Skipped))
+				contents.WriteString("\"/>\n")
+				continue
+			}
+			contents.WriteString("<document path=\"")
+			xml.EscapeText(&contents, []byte(file.Path))
+			if file.StartLine != 0 {
+				fmt.Fprintf(&contents, "\" lines=\"%d-%d", file.StartLine, file.EndLine)
+			}
+			// CDATA keeps the content verbatim, only its terminator has to be split
+			fmt.Fprintf(&contents, "\">\n<![CDATA[%s]]>\n</document>\n", strings.ReplaceAll(file.Content, "]]>", "]]]]><![CDATA[>"))
+		}
+		contents.WriteString("</documents>\n")
+	case formatJSON:
+		encoder := json.NewEncoder(&contents)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(files)
+	default:
+		for _, file := range files {
+			if file.Skipped == "" {
+				fmt.Fprintf(&contents, "---------------\nFile: %s:\n\n%s\n\n", file.label(), file.Content)
+			}
+		}
+		if len(skipped) > 0 {
+			contents.WriteString("---------------\nSkipped files:\n\n")
+			for _, file := range skipped {
+				fmt.Fprintf(&contents, "%s: %s\n", file.Path, file.Skipped)
+			}
+		}
+	}
+	return contents.String()
+}
+
+// readDirContents concatenates every file of the project under relativePath
+// that passes the filter in the given format, masking their secrets when
+// redact is set
+func readDirContents(config Config, relativePath, format string, redact bool) (string, error) {
+	files, err := collectDirContents(config, relativePath)
+	if err != nil {
+		return "", err
+	}
+	if redact {
+		redactContents(config, files)
+	}
+	return formatContents(files, format), nil
+}
+
+// markdownFence returns a code fence longer than any backtick run in content
+func markdownFence(content string) string {
+	longest, run := 0, 0
+	for _, c := range content {
+		if c == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// countLines returns the number of lines of a file, a last line without a
+// trailing newline included
+func countLines(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	lines := strings.Count(string(data), "\n")
+	if data[len(data)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// depNode is a file, a directory of the project (a package), or an
+// import outside the project
+type depNode struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"` // "file", "package" or "external"
+	Language string `json:"language,omitempty"`
+}
+
+type depEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type depGraph struct {
+	Project string    `json:"project"`
+	Level   string    `json:"level"`
+	Nodes   []depNode `json:"nodes"`
+	Edges   []depEdge `json:"edges"`
+}
+
+// Extensions of the JS/TS files whose imports are followed, in the order an
+// extensionless import is resolved
+var jsExtensions = []string{"ts", "tsx", "js", "jsx", "mjs", "cjs"}
+
+var (
+	jsImportPattern  = regexp.MustCompile(`(?m)^\s*(?:import|export)\s+(?:[^'"]*?\s+from\s+)?['"]([^'"\n]+)['"]`)
+	jsRequirePattern = regexp.MustCompile(`(?:\brequire|\bimport)\s*\(\s*['"]([^'"\n]+)['"]\s*\)`)
+)
+
+// depSource is where a file of the graph is read from
+type depSource struct {
+	root *projectRoot
+	name string
+}
+
+// goModule is a go.mod found in the project
+type goModule struct {
+	Path string // module path
+	Dir  string // slash separated directory relative to the project, "" for its top
+}
+
+// buildDepGraph parses the imports of the Go and JS/TS files that pass the
+// project's filter and links them, at file or package (directory) level.
+// Imports outside the project are only kept when external is set.
+func buildDepGraph(config Config, project string, level string, external bool) (*depGraph, error) {
+	var files []string // slash separated, relative to the project
+	fileSet := make(map[string]bool)
+	sources := make(map[string]depSource)
+	goPackages := make(map[string][]string) // directory -> Go files
+	var modules []goModule
+	// The roots of a project with several are visited by the walk
+	if root, name, err := resolvePath(config, ""); err == nil && root != nil {
+		modules = findGoModules(root, name, "")
+	}
+
+	err := walkProject(config, "", func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			modules = append(modules, findGoModules(root, name, fileRelativePath)...)
+			return nil
+		}
+		files = append(files, fileRelativePath)
+		sources[fileRelativePath] = depSource{root: root, name: name}
+		fileSet[fileRelativePath] = true
+		if strings.HasSuffix(fileRelativePath, ".go") && !strings.HasSuffix(fileRelativePath, "_test.go") {
+			dir := path.Dir(fileRelativePath)
+			goPackages[dir] = append(goPackages[dir], fileRelativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The innermost module wins when they are nested
+	sort.Slice(modules, func(i, j int) bool { return len(modules[i].Dir) > len(modules[j].Dir) })
+
+	graph := &depGraph{Project: project, Level: level}
+	nodes := make(map[string]depNode)
+	edges := make(map[depEdge]bool)
+	addEdge := func(from depNode, to depNode) {
+		if level == "package" {
+			from, to = packageNode(from), packageNode(to)
+			if from.ID == to.ID {
+				return
+			}
+		}
+		nodes[from.ID] = from
+		nodes[to.ID] = to
+		edges[depEdge{From: from.ID, To: to.ID}] = true
+	}
+
+	for _, file := range files {
+		ext := strings.TrimPrefix(path.Ext(file), ".")
+		source := sources[file]
+		switch {
+		case ext == "go":
+			from := depNode{ID: "/" + file, Kind: "file", Language: "Go"}
+			nodes[from.ID] = from
+			for _, importPath := range goImports(source.root, source.name) {
+				dir, ok := resolveGoImport(importPath, modules)
+				if !ok || len(goPackages[dir]) == 0 {
+					if external {
+						addEdge(from, depNode{ID: importPath, Kind: "external", Language: "Go"})
+					}
+					continue
+				}
+				for _, target := range goPackages[dir] {
+					if target != file {
+						addEdge(from, depNode{ID: "/" + target, Kind: "file", Language: "Go"})
+					}
+				}
+			}
+		case contains(jsExtensions, ext):
+			from := depNode{ID: "/" + file, Kind: "file", Language: "JavaScript"}
+			if strings.HasPrefix(ext, "ts") {
+				from.Language = "TypeScript"
+			}
+			nodes[from.ID] = from
+			for _, spec := range jsImports(source.root, source.name) {
+				if !strings.HasPrefix(spec, "./") && !strings.HasPrefix(spec, "../") {
+					if external {
+						addEdge(from, depNode{ID: spec, Kind: "external", Language: from.Language})
+					}
+					continue
+				}
+				if target, ok := resolveJSImport(path.Dir(file), spec, fileSet); ok {
+					language := "JavaScript"
+					if strings.HasPrefix(strings.TrimPrefix(path.Ext(target), "."), "ts") {
+						language = "TypeScript"
+					}
+					addEdge(from, depNode{ID: "/" + target, Kind: "file", Language: language})
+				}
+			}
+		}
+	}
+
+	if level == "package" {
+		// Keep the packages of files without internal imports as well
+		for id, node := range nodes {
+			if node.Kind == "file" {
+				delete(nodes, id)
+				if pkg := packageNode(node); nodes[pkg.ID].ID == "" {
+					nodes[pkg.ID] = pkg
+				}
+			}
+		}
+	}
+
+	graph.Nodes = []depNode{}
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+	graph.Edges = []depEdge{}
+	for edge := range edges {
+		graph.Edges = append(graph.Edges, edge)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+	return graph, nil
+}
+
+// packageNode turns a file node into the node of its directory
+func packageNode(node depNode) depNode {
+	if node.Kind != "file" {
+		return node
+	}
+	dir := path.Dir(node.ID)
+	return depNode{ID: dir, Kind: "package", Language: node.Language}
+}
+
+// findGoModules reads the module path of dir/go.mod in the root, if there is
+// one
+func findGoModules(root *projectRoot, dir string, relativePath string) []goModule {
+	file, err := root.FS.Open(path.Join(dir, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "module" {
+			modulePath, err := strconv.Unquote(fields[1])
+			if err != nil {
+				modulePath = fields[1]
+			}
+			return []goModule{{Path: modulePath, Dir: relativePath}}
+		}
+	}
+	return nil
+}
+
+// resolveGoImport returns the project directory of an import path that
+// belongs to one of the project's modules
+func resolveGoImport(importPath string, modules []goModule) (string, bool) {
+	for _, module := range modules {
+		if importPath == module.Path || strings.HasPrefix(importPath, module.Path+"/") {
+			dir := path.Join(module.Dir, strings.TrimPrefix(strings.TrimPrefix(importPath, module.Path), "/"))
+			if dir == "" {
+				dir = "."
+			}
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// goImports parses the import declarations of a Go file
+func goImports(root *projectRoot, name string) []string {
+	data, skipped, err := root.readTextFile(name)
+	if err != nil || skipped != "" {
+		return nil
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), name, data, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	var imports []string
+	for _, spec := range file.Imports {
+		if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+			imports = append(imports, importPath)
+		}
+	}
+	return imports
+}
+
+// jsImports finds the import, export from, require and dynamic import
+// specifiers of a JS/TS file
+func jsImports(root *projectRoot, name string) []string {
+	data, skipped, err := root.readTextFile(name)
+	if err != nil || skipped != "" {
+		return nil
+	}
+	var specs []string
+	for _, pattern := range []*regexp.Regexp{jsImportPattern, jsRequirePattern} {
+		for _, match := range pattern.FindAllStringSubmatch(string(data), -1) {
+			specs = append(specs, match[1])
+		}
+	}
+	return specs
+}
+
+// resolveJSImport resolves a relative specifier the way bundlers do: the
+// exact file, then with an extension, then an index file. TypeScript files
+// importing "./x.js" get "./x.ts".
+func resolveJSImport(dir string, spec string, fileSet map[string]bool) (string, bool) {
+	target := path.Join(dir, spec)
+	candidates := []string{target}
+	for _, ext := range jsExtensions {
+		candidates = append(candidates, target+"."+ext)
+	}
+	for _, ext := range jsExtensions {
+		candidates = append(candidates, target+"/index."+ext)
+	}
+	if trimmed := strings.TrimSuffix(target, ".js"); trimmed != target {
+		candidates = append(candidates, trimmed+".ts", trimmed+".tsx")
+	}
+	for _, candidate := range candidates {
+		if fileSet[candidate] {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// formatDepGraph renders a graph as JSON, Graphviz DOT or Mermaid
+func formatDepGraph(graph *depGraph, format string) string {
+	var out strings.Builder
+	switch format {
+	case "dot":
+		fmt.Fprintf(&out, "digraph %q {\n  rankdir=LR;\n  node [shape=box];\n", graph.Project)
+		for _, node := range graph.Nodes {
+			if node.Kind == "external" {
+				fmt.Fprintf(&out, "  %q [style=dashed];\n", node.ID)
+			} else {
+				fmt.Fprintf(&out, "  %q;\n", node.ID)
+			}
+		}
+		for _, edge := range graph.Edges {
+			fmt.Fprintf(&out, "  %q -> %q;\n", edge.From, edge.To)
+		}
+		out.WriteString("}\n")
+	case "mermaid":
+		out.WriteString("graph LR\n")
+		ids := make(map[string]string)
+		for i, node := range graph.Nodes {
+			ids[node.ID] = fmt.Sprintf("n%d", i)
+			label := strings.ReplaceAll(node.ID, `"`, "#quot;")
+			if node.Kind == "external" {
+				fmt.Fprintf(&out, "  %s([\"%s\"])\n", ids[node.ID], label)
+			} else {
+				fmt.Fprintf(&out, "  %s[\"%s\"]\n", ids[node.ID], label)
+			}
+		}
+		for _, edge := range graph.Edges {
+			fmt.Fprintf(&out, "  %s --> %s\n", ids[edge.From], ids[edge.To])
+		}
+	default:
+		encoder := json.NewEncoder(&out)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(graph)
+	}
+	return out.String()
+}
+
+// depsHandler serves the import graph of a project. ?level=file|package
+// selects the nodes, ?format=json|dot|mermaid the output and ?external=true
+// keeps imports from outside the project.
+func depsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	level := query.Get("level")
+	if level == "" {
+		level = "file"
+	}
+	if level != "file" && level != "package" {
+		http.Error(w, "Invalid level, expected file or package", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	contentType := "application/json"
+	switch format {
+	case "", "json":
+	case "dot":
+		contentType = "text/vnd.graphviz; charset=UTF-8"
+	case "mermaid":
+		contentType = "text/plain; charset=UTF-8"
+	default:
+		http.Error(w, "Invalid format, expected json, dot or mermaid", http.StatusBadRequest)
+		return
+	}
+
+	graph, err := buildDepGraph(configs[project+".json"], project, level, query.Get("external") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(formatDepGraph(graph, format)))
+}
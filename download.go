@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Name of the manifest added at the root of a zip download
+const zipManifestName = "minragserver-manifest.json"
+
+// zipManifest tells what a zip download holds and the filters that chose it
+type zipManifest struct {
+	Project     string           `json:"project"`
+	ProjectName string           `json:"project_name"`
+	Path        string           `json:"path"`
+	Filters     []manifestFilter `json:"filters"`
+	Files       []string         `json:"files"`
+	Skipped     []contentFile    `json:"skipped"`
+}
+
+// manifestFilter is the filter of one root of the project
+type manifestFilter struct {
+	Root                string   `json:"root,omitempty"`
+	InclusiveExtensions []string `json:"inclusive_extensions"`
+	ExclusiveExtensions []string `json:"exclusive_extensions"`
+	ExclusiveFolders    []string `json:"exclusive_folders"`
+	ExclusiveFiles      []string `json:"exclusive_files"`
+	ShowHidden          bool     `json:"show_hidden"`
+	MaxFileSize         int64    `json:"max_file_size"`
+}
+
+// writeZip writes the files /c would include under relativePath to a zip
+// archive, with their path in the project, and the manifest last. Binary
+// and oversized files are left out and listed in the manifest. With redact,
+// the secrets of the files are masked.
+func writeZip(w *zip.Writer, config Config, project string, relativePath string, redact bool) error {
+	relativePath = strings.Trim(filepath.ToSlash(relativePath), "/")
+	roots, err := projectRoots(config)
+	if err != nil {
+		return err
+	}
+	manifest := zipManifest{
+		Project:     project,
+		ProjectName: config.ProjectName,
+		Path:        "/" + relativePath,
+		Filters:     []manifestFilter{},
+		Files:       []string{},
+		Skipped:     []contentFile{},
+	}
+	for _, root := range roots {
+		manifest.Filters = append(manifest.Filters, manifestFilter{
+			Root:                root.Name,
+			InclusiveExtensions: nonEmpty(root.Filter.InclusiveExtensions),
+			ExclusiveExtensions: nonEmpty(root.Filter.ExclusiveExtensions),
+			ExclusiveFolders:    nonEmpty(root.Filter.ExclusiveFolders),
+			ExclusiveFiles:      nonEmpty(root.Filter.ExclusiveFiles),
+			ShowHidden:          root.Filter.ShowHidden,
+			MaxFileSize:         root.Filter.MaxFileSize,
+		})
+	}
+
+	var lastModified time.Time
+	err = walkProjectFiles(config, relativePath, func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		data, skipped, err := root.readTextFile(name)
+		if err != nil {
+			return err
+		}
+		if skipped != "" {
+			manifest.Skipped = append(manifest.Skipped, contentFile{Path: "/" + fileRelativePath, Skipped: skipped})
+			return nil
+		}
+		header := &zip.FileHeader{Name: fileRelativePath, Method: zip.Deflate}
+		if info, err := entry.Info(); err == nil {
+			header.Modified = info.ModTime()
+			if header.Modified.After(lastModified) {
+				lastModified = header.Modified
+			}
+		}
+		file, err := w.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if redact {
+			text, _ := redactText(config, "/"+fileRelativePath, string(data))
+			data = []byte(text)
+		}
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, "/"+fileRelativePath)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Dated like the newest file, so the same tree always gives the same archive
+	file, err := w.CreateHeader(&zip.FileHeader{Name: zipManifestName, Method: zip.Deflate, Modified: lastModified})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+// nonEmpty drops the empty entry a filter gets from an empty setting
+func nonEmpty(items []string) []string {
+	list := []string{}
+	for _, item := range items {
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// zipHandler streams the files /c would include for a subtree as a zip
+// download
+func zipHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+	path := vars["relativePath"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	root, name, err := resolvePath(selectedConfig, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if root != nil {
+		info, err := fs.Stat(root.FS, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !info.IsDir() {
+			http.Error(w, "Not a directory, use /f to download a file", http.StatusBadRequest)
+			return
+		}
+	}
+
+	redact := shouldRedact(r)
+	variant := "zip"
+	if redact {
+		variant += ":redacted"
+	}
+	if etag, lastModified, err := treeETag(selectedConfig, path, variant); err == nil {
+		if checkNotModified(w, r, etag, lastModified) {
+			return
+		}
+	}
+
+	fileName := project
+	if trimmed := strings.Trim(filepath.ToSlash(path), "/"); trimmed != "" {
+		fileName += "-" + strings.ReplaceAll(trimmed, "/", "-")
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName+".zip"))
+
+	// The response has started, so an error can only cut the archive short
+	archive := zip.NewWriter(w)
+	if err := writeZip(archive, selectedConfig, project, path, redact); err != nil {
+		fmt.Println("Error writing zip of", project+"/"+path+":", err)
+		return
+	}
+	archive.Close()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Embedder turns texts into vectors whose dot product tells how close their
+// meaning is. Vectors are normalized to a length of 1.
+type Embedder interface {
+	Embed(texts []string) ([][]float32, error)
+	// ID changes whenever the vectors would, so indexes know to rebuild
+	ID() string
+}
+
+// Size of the vectors of the hashing embedder
+const hashEmbedderDimensions = 1024
+
+// Texts sent at once to an embedding server
+const embeddingBatchSize = 64
+
+// newEmbedder returns the embedder configured in the settings: an
+// OpenAI-compatible server when embedding_url is set, the local hashing
+// embedder otherwise
+func newEmbedder(settings GeneralSettings) Embedder {
+	if settings.EmbeddingURL == "" {
+		return hashEmbedder{dimensions: hashEmbedderDimensions}
+	}
+	return &httpEmbedder{
+		url:    embeddingsEndpoint(settings.EmbeddingURL),
+		model:  settings.EmbeddingModel,
+		apiKey: settings.EmbeddingAPIKey,
+		client: &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// embeddingsEndpoint accepts the base URL of the API, such as
+// http://localhost:11434/v1, or the full /embeddings URL
+func embeddingsEndpoint(baseURL string) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if strings.HasSuffix(baseURL, "/embeddings") {
+		return baseURL
+	}
+	return baseURL + "/embeddings"
+}
+
+// hashEmbedder maps the terms of a text and their character trigrams into a
+// fixed number of dimensions, so texts sharing words, or parts of words, end
+// up close. It needs no model and always gives the same vectors.
+type hashEmbedder struct {
+	dimensions int
+}
+
+func (e hashEmbedder) ID() string {
+	return fmt.Sprintf("hash-%d", e.dimensions)
+}
+
+func (e hashEmbedder) Embed(texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = e.embed(text)
+	}
+	return vectors, nil
+}
+
+func (e hashEmbedder) embed(text string) []float32 {
+	features := make(map[string]float64)
+	for _, term := range textTerms(text) {
+		features[term]++
+		// Trigrams match the variants of a word the stemming misses
+		padded := "<" + term + ">"
+		for i := 0; i+3 <= len(padded); i++ {
+			features["#"+padded[i:i+3]] += 0.25
+		}
+	}
+
+	vector := make([]float32, e.dimensions)
+	for feature, count := range features {
+		hash := fnv.New64a()
+		hash.Write([]byte(feature))
+		sum := hash.Sum64()
+		// The sign bit spreads the collisions evenly around zero
+		weight := float32(math.Log1p(count))
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[sum%uint64(e.dimensions)] += weight
+	}
+	normalize(vector)
+	return vector
+}
+
+// Words too common in text and code to tell chunks apart
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "this": true, "that": true, "from": true,
+	"are": true, "was": true, "not": true, "but": true, "its": true, "into": true, "our": true,
+	"we": true, "do": true, "to": true, "of": true, "in": true, "on": true, "is": true, "it": true,
+	"be": true, "or": true, "as": true, "at": true, "by": true, "an": true, "if": true,
+	"where": true, "what": true, "how": true, "which": true,
+	"func": true, "return": true, "var": true, "const": true, "nil": true, "else": true,
+}
+
+// textTerms splits a text into lowercase words, breaking identifiers such as
+// newServer, HTTPClient or retry_count into their words, and keeping a
+// compound identifier whole as well. Plurals are reduced to the singular.
+func textTerms(text string) []string {
+	var terms []string
+	addWord := func(word string) {
+		word = stemWord(strings.ToLower(word))
+		if len(word) > 1 && !stopWords[word] {
+			terms = append(terms, word)
+		}
+	}
+
+	for _, identifier := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		parts := identifierParts(identifier)
+		for _, part := range parts {
+			addWord(part)
+		}
+		if len(parts) > 1 {
+			addWord(strings.ReplaceAll(identifier, "_", ""))
+		}
+	}
+	return terms
+}
+
+// identifierParts splits an identifier at underscores and case changes
+func identifierParts(identifier string) []string {
+	var parts []string
+	for _, word := range strings.Split(identifier, "_") {
+		runes := []rune(word)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			lowerToUpper := unicode.IsLower(runes[i-1]) && unicode.IsUpper(runes[i])
+			// The last capital of an acronym starts the next word, as in HTTPClient
+			acronymEnd := unicode.IsUpper(runes[i-1]) && unicode.IsUpper(runes[i]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if lowerToUpper || acronymEnd {
+				parts = append(parts, string(runes[start:i]))
+				start = i
+			}
+		}
+		if start < len(runes) {
+			parts = append(parts, string(runes[start:]))
+		}
+	}
+	return parts
+}
+
+// stemWord reduces the usual English plurals to their singular
+func stemWord(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return word[:len(word)-3] + "y"
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us"):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+func normalize(vector []float32) {
+	var sum float64
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	if sum == 0 {
+		return
+	}
+	length := float32(math.Sqrt(sum))
+	for i := range vector {
+		vector[i] /= length
+	}
+}
+
+// dot is the cosine similarity of normalized vectors, 0 for vectors of
+// different models
+func dot(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// httpEmbedder calls the /embeddings endpoint of an OpenAI-compatible API,
+// such as a local Ollama, llama.cpp or vLLM server
+type httpEmbedder struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+func (e *httpEmbedder) ID() string {
+	return "http:" + e.url + ":" + e.model
+}
+
+func (e *httpEmbedder) Embed(texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		batch, err := e.embedBatch(texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, batch...)
+	}
+	return vectors, nil
+}
+
+func (e *httpEmbedder) embedBatch(texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": e.model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	response, err := e.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("embedding server: %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding server returned %d vectors for %d texts", len(result.Data), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, errors.New("embedding server returned an invalid index")
+		}
+		normalize(item.Embedding)
+		vectors[item.Index] = item.Embedding
+	}
+	for _, vector := range vectors {
+		if vector == nil {
+			return nil, errors.New("embedding server skipped a text")
+		}
+	}
+	return vectors, nil
+}
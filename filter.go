@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// fileFilter holds the visibility rules of a project, taken from its config
+// or from the general settings when the project doesn't set them.
+type fileFilter struct {
+	InclusiveExtensions []string
+	ExclusiveExtensions []string
+	ExclusiveFolders    []string
+	ExclusiveFiles      []string
+	ShowHidden          bool
+	MaxFileSize         int64 // 0 or less means no limit
+	// Name of the root the filter belongs to in a project with several
+	// roots, which prefixes the relative paths walked
+	Prefix string
+}
+
+// Get the configurations from the project or from general settings
+func newFileFilter(config Config) fileFilter {
+	inclusiveExtensions := strings.Split(config.InclusiveExtensions, ",")
+	if inclusiveExtensions[0] == "" {
+		inclusiveExtensions = strings.Split(generalSettings.InclusiveExtensions, ",")
+	}
+	exclusiveExtensions := strings.Split(config.ExclusiveExtensions, ",")
+	if exclusiveExtensions[0] == "" {
+		exclusiveExtensions = strings.Split(generalSettings.ExclusiveExtensions, ",")
+	}
+	exclusiveFolders := strings.Split(config.ExclusiveFolders, ",")
+	if exclusiveFolders[0] == "" {
+		exclusiveFolders = strings.Split(generalSettings.ExclusiveFolders, ",")
+	}
+	// A project can lift the general limit with a negative max_file_size
+	maxFileSize := config.MaxFileSize
+	if maxFileSize == 0 {
+		maxFileSize = generalSettings.MaxFileSize
+	}
+	return fileFilter{
+		InclusiveExtensions: inclusiveExtensions,
+		ExclusiveExtensions: exclusiveExtensions,
+		ExclusiveFolders:    exclusiveFolders,
+		ExclusiveFiles:      strings.Split(config.ExclusiveFiles, ","),
+		ShowHidden:          generalSettings.ShowHidden,
+		MaxFileSize:         maxFileSize,
+	}
+}
+
+// skipHidden reports whether a hidden file or directory should be skipped
+func (f fileFilter) skipHidden(name string) bool {
+	return !f.ShowHidden && strings.HasPrefix(name, ".")
+}
+
+// excludeDir reports whether a directory is excluded, relativePath being its
+// slash separated path from the project root
+func (f fileFilter) excludeDir(relativePath string, dirName string) bool {
+	relativePath = strings.TrimPrefix(relativePath, "/")
+	// Folder patterns are relative to the root the directory belongs to
+	if f.Prefix != "" && (relativePath == f.Prefix || strings.HasPrefix(relativePath, f.Prefix+"/")) {
+		relativePath = strings.TrimPrefix(relativePath[len(f.Prefix):], "/")
+	}
+	return checkExclusiveDir(f.ExclusiveFolders, fmt.Sprintf("/%s", relativePath), dirName)
+}
+
+// includeFile reports whether a file passes the exclusive files and the
+// extension filters
+func (f fileFilter) includeFile(fileName string) bool {
+	if contains(f.ExclusiveFiles, fileName) {
+		return false
+	}
+	ext := filepath.Ext(fileName)
+	if len(ext) > 0 {
+		ext = ext[1:] // Remove the leading "."
+	}
+	return (len(f.InclusiveExtensions) == 0 || f.InclusiveExtensions[0] == "*" || contains(f.InclusiveExtensions, ext)) &&
+		(len(f.ExclusiveExtensions) == 0 || !contains(f.ExclusiveExtensions, ext))
+}
@@ -1,5 +1,12 @@
 module MinRAGServer
 
-go 1.20
+go 1.22
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/gorilla/mux v1.8.1
+	github.com/klauspost/compress v1.18.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// language describes how comments are written in a programming language,
+// and how markdown code blocks of it are tagged
+type language struct {
+	Name          string
+	Fence         string
+	LineComments  []string
+	BlockComments [][2]string
+}
+
+var (
+	cStyle   = language{LineComments: []string{"//"}, BlockComments: [][2]string{{"/*", "*/"}}}
+	hashOnly = language{LineComments: []string{"#"}}
+	htmlLike = language{BlockComments: [][2]string{{"<!--", "-->"}}}
+)
+
+func (l language) named(name, fence string) *language {
+	l.Name = name
+	l.Fence = fence
+	return &l
+}
+
+// Languages by file extension
+var languagesByExtension = map[string]*language{
+	"c": cStyle.named("C", "c"), "h": cStyle.named("C", "c"),
+	"cc": cStyle.named("C++", "cpp"), "cpp": cStyle.named("C++", "cpp"), "hpp": cStyle.named("C++", "cpp"),
+	"cs":   cStyle.named("C#", "csharp"),
+	"css":  (&language{BlockComments: [][2]string{{"/*", "*/"}}}).named("CSS", "css"),
+	"scss": cStyle.named("SCSS", "scss"),
+	"dart": cStyle.named("Dart", "dart"),
+	"go":   cStyle.named("Go", "go"),
+	"java": cStyle.named("Java", "java"),
+	"js":   cStyle.named("JavaScript", "javascript"), "jsx": cStyle.named("JavaScript", "jsx"), "mjs": cStyle.named("JavaScript", "javascript"), "cjs": cStyle.named("JavaScript", "javascript"),
+	"ts": cStyle.named("TypeScript", "typescript"), "tsx": cStyle.named("TypeScript", "tsx"),
+	"kt":    cStyle.named("Kotlin", "kotlin"),
+	"swift": cStyle.named("Swift", "swift"),
+	"rs":    cStyle.named("Rust", "rust"),
+	"php":   (&language{LineComments: []string{"//", "#"}, BlockComments: [][2]string{{"/*", "*/"}}}).named("PHP", "php"),
+	"py":    (&language{LineComments: []string{"#"}, BlockComments: [][2]string{{`"""`, `"""`}, {"'''", "'''"}}}).named("Python", "python"),
+	"rb":    hashOnly.named("Ruby", "ruby"),
+	"sh":    hashOnly.named("Shell", "bash"), "bash": hashOnly.named("Shell", "bash"),
+	"yaml": hashOnly.named("YAML", "yaml"), "yml": hashOnly.named("YAML", "yaml"),
+	"toml": hashOnly.named("TOML", "toml"),
+	"sql":  (&language{LineComments: []string{"--"}, BlockComments: [][2]string{{"/*", "*/"}}}).named("SQL", "sql"),
+	"html": htmlLike.named("HTML", "html"), "htm": htmlLike.named("HTML", "html"),
+	"xml":  htmlLike.named("XML", "xml"),
+	"md":   htmlLike.named("Markdown", "markdown"),
+	"json": (&language{}).named("JSON", "json"),
+}
+
+// languageOf returns the language of a file from its extension, nil when
+// it isn't known
+func languageOf(fileName string) *language {
+	return languagesByExtension[strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))]
+}
+
+// markdownLanguage returns the tag of a markdown code block holding a file,
+// empty when its language isn't known
+func markdownLanguage(fileName string) string {
+	if lang := languageOf(fileName); lang != nil {
+		return lang.Fence
+	}
+	return ""
+}
+
+// lineCounts splits the lines of a file into code, comment and blank lines
+type lineCounts struct {
+	Code     int `json:"code"`
+	Comments int `json:"comments"`
+	Blank    int `json:"blank"`
+}
+
+// countLineKinds classifies every line of content. A line holding both code
+// and a comment counts as code.
+func countLineKinds(content string, lang *language) lineCounts {
+	var counts lineCounts
+	if content == "" {
+		return counts
+	}
+	inBlock := ""
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			counts.Blank++
+			continue
+		}
+		if lang == nil {
+			counts.Code++
+			continue
+		}
+
+		code := false
+		for line != "" {
+			if inBlock != "" {
+				end := strings.Index(line, inBlock)
+				if end < 0 {
+					line = ""
+					break
+				}
+				line = strings.TrimSpace(line[end+len(inBlock):])
+				inBlock = ""
+				continue
+			}
+			if hasAnyPrefix(line, lang.LineComments) {
+				break
+			}
+			if start, end := blockCommentStart(line, lang.BlockComments); start != "" {
+				line = strings.TrimSpace(line[len(start):])
+				inBlock = end
+				continue
+			}
+			// Code up to the next comment, if any
+			code = true
+			next := len(line)
+			for _, marker := range lang.LineComments {
+				if i := strings.Index(line, marker); i >= 0 && i < next {
+					next = i
+				}
+			}
+			for _, block := range lang.BlockComments {
+				if i := strings.Index(line, block[0]); i >= 0 && i < next {
+					next = i
+				}
+			}
+			if next == len(line) {
+				break
+			}
+			line = line[next:]
+		}
+		if code {
+			counts.Code++
+		} else {
+			counts.Comments++
+		}
+	}
+	return counts
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockCommentStart returns the delimiters of the block comment line starts
+// with, if any
+func blockCommentStart(line string, blocks [][2]string) (string, string) {
+	for _, block := range blocks {
+		if strings.HasPrefix(line, block[0]) {
+			return block[0], block[1]
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// BM25 parameters: how fast repeating a term stops counting, and how much
+// long chunks are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// lexicalIndex scores the chunks of a vectorIndex by the words they share
+// with a query, using BM25
+type lexicalIndex struct {
+	terms     []map[string]int // counts of each term, by chunk
+	lengths   []int            // terms in each chunk
+	docFreq   map[string]int   // chunks containing each term
+	avgLength float64
+}
+
+// lexicalMatch is a chunk of the index, by position, and its score
+type lexicalMatch struct {
+	chunk int
+	score float64
+}
+
+func buildLexicalIndex(chunks []chunk) *lexicalIndex {
+	index := &lexicalIndex{
+		terms:   make([]map[string]int, len(chunks)),
+		lengths: make([]int, len(chunks)),
+		docFreq: make(map[string]int),
+	}
+	total := 0
+	for i, c := range chunks {
+		counts := make(map[string]int)
+		for _, term := range textTerms(embeddingText(c)) {
+			counts[term]++
+			index.lengths[i]++
+		}
+		for term := range counts {
+			index.docFreq[term]++
+		}
+		index.terms[i] = counts
+		total += index.lengths[i]
+	}
+	if len(chunks) > 0 {
+		index.avgLength = float64(total) / float64(len(chunks))
+	}
+	return index
+}
+
+// search returns the chunks containing any term of the query, best first
+func (index *lexicalIndex) search(query string) []lexicalMatch {
+	seen := make(map[string]bool)
+	var queryTerms []string
+	for _, term := range textTerms(query) {
+		if !seen[term] {
+			seen[term] = true
+			queryTerms = append(queryTerms, term)
+		}
+	}
+
+	n := float64(len(index.terms))
+	var matches []lexicalMatch
+	for i, counts := range index.terms {
+		score := 0.0
+		for _, term := range queryTerms {
+			tf := float64(counts[term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(index.docFreq[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := 1 - bm25B + bm25B*float64(index.lengths[i])/index.avgLength
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+		if score > 0 {
+			matches = append(matches, lexicalMatch{chunk: i, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	return matches
+}
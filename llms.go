@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Token budget of llms-full.txt when ?budget= isn't given
+const llmsFullDefaultBudget = 100000
+
+// Most key files listed in llms.txt
+const maxKeyFiles = 20
+
+// Deepest directory, below the top of a root, where key files are looked for
+const maxKeyFileDepth = 2
+
+// Longest summary taken from the README, in bytes
+const maxSummaryLength = 500
+
+// Kinds of key files, in the order they are listed
+var keyFileKinds = []string{"documentation", "manifest", "entry point"}
+
+var manifestNames = []string{
+	"go.mod", "package.json", "cargo.toml", "pyproject.toml", "setup.py", "requirements.txt",
+	"pom.xml", "build.gradle", "build.gradle.kts", "composer.json", "gemfile", "pubspec.yaml",
+	"makefile", "dockerfile", "docker-compose.yml", "compose.yaml", "cmakelists.txt",
+}
+
+var entryPointNames = []string{
+	"main.go", "main.py", "app.py", "__main__.py", "main.rs", "lib.rs", "main.dart", "program.cs",
+	"index.js", "index.ts", "index.tsx", "main.js", "main.ts", "main.tsx", "app.js", "app.ts", "app.tsx",
+	"server.js", "server.ts", "main.c", "main.cpp", "main.java", "main.kt", "main.swift",
+}
+
+// keyFileKind tells whether a file is documentation, a manifest or an entry
+// point of a project, -1 meaning none of them
+func keyFileKind(fileName string) int {
+	lower := strings.ToLower(fileName)
+	switch {
+	case strings.HasPrefix(lower, "readme"), lower == "contributing.md", lower == "architecture.md":
+		return 0
+	case contains(manifestNames, lower), strings.HasSuffix(lower, ".csproj"):
+		return 1
+	case contains(entryPointNames, lower):
+		return 2
+	}
+	return -1
+}
+
+// llmsFile is a file of the project considered for llms.txt
+type llmsFile struct {
+	Path  string // in the project, with a leading slash
+	Kind  int    // from keyFileKind
+	Depth int    // below the top of its root
+	root  *projectRoot
+	name  string
+}
+
+// collectLlmsFiles lists the files /c would include for the whole project,
+// key files first, then by depth and path
+func collectLlmsFiles(config Config) ([]llmsFile, error) {
+	var files []llmsFile
+	err := walkProjectFiles(config, "", func(root *projectRoot, name, fileRelativePath string, _ fs.DirEntry) error {
+		depth := strings.Count(name, "/")
+		kind := keyFileKind(path.Base(name))
+		if depth > maxKeyFileDepth {
+			kind = -1
+		}
+		files = append(files, llmsFile{Path: "/" + fileRelativePath, Kind: kind, Depth: depth, root: root, name: name})
+		return nil
+	})
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if (a.Kind < 0) != (b.Kind < 0) {
+			return a.Kind >= 0
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Depth != b.Depth {
+			return a.Depth < b.Depth
+		}
+		return a.Path < b.Path
+	})
+	return files, err
+}
+
+// readmeSummary returns the first paragraph of the project's top README
+func readmeSummary(files []llmsFile) string {
+	for _, file := range files {
+		if file.Kind != 0 || file.Depth != 0 || !strings.HasPrefix(strings.ToLower(path.Base(file.name)), "readme") {
+			continue
+		}
+		data, skipped, err := file.root.readTextFile(file.name)
+		if err != nil || skipped != "" {
+			continue
+		}
+		var paragraph []string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+				if len(paragraph) > 0 {
+					return truncateSummary(strings.Join(paragraph, " "))
+				}
+			case strings.HasPrefix(line, "#"), strings.HasPrefix(line, "[!["), strings.HasPrefix(line, "<"),
+				strings.HasPrefix(line, "```"), strings.HasPrefix(line, "==="), strings.HasPrefix(line, "---"):
+				// Headings, badges, HTML and fences say little about the project
+				if len(paragraph) > 0 {
+					return truncateSummary(strings.Join(paragraph, " "))
+				}
+			default:
+				paragraph = append(paragraph, line)
+			}
+		}
+		if len(paragraph) > 0 {
+			return truncateSummary(strings.Join(paragraph, " "))
+		}
+	}
+	return ""
+}
+
+func truncateSummary(summary string) string {
+	if len(summary) <= maxSummaryLength {
+		return summary
+	}
+	return strings.ToValidUTF8(summary[:maxSummaryLength], "") + "..."
+}
+
+// writeLlmsHeader writes the title, summary and size of the project that
+// start both llms.txt and llms-full.txt, and returns the stats of the project
+func writeLlmsHeader(b *strings.Builder, config Config, project string, files []llmsFile) (*projectStats, error) {
+	stats, err := collectProjectStats(config, project, "")
+	if err != nil {
+		return nil, err
+	}
+	summary := readmeSummary(files)
+	if summary == "" {
+		summary = "Source code of " + config.ProjectName
+	}
+	fmt.Fprintf(b, "# %s\n\n> %s\n\n", config.ProjectName, summary)
+
+	fmt.Fprintf(b, "%d files, %d lines, ~%s tokens.", stats.Files, stats.Lines, formatCount(stats.Tokens))
+	var languages []string
+	for _, language := range stats.Languages {
+		if language.Language == "Other" || len(languages) == 3 {
+			continue
+		}
+		files := "files"
+		if language.Files == 1 {
+			files = "file"
+		}
+		languages = append(languages, fmt.Sprintf("%s (%d %s)", language.Language, language.Files, files))
+	}
+	if len(languages) > 0 {
+		fmt.Fprintf(b, " Main languages: %s.", strings.Join(languages, ", "))
+	}
+	b.WriteString("\n\n")
+	return stats, nil
+}
+
+// buildLlmsTxt writes the llms.txt of a project: a summary and links to its
+// key files, to its structure and content URLs and to its top directories
+func buildLlmsTxt(config Config, project string) (string, error) {
+	files, err := collectLlmsFiles(config)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	stats, err := writeLlmsHeader(&b, config, project, files)
+	if err != nil {
+		return "", err
+	}
+	base := config.ProjectURL
+	b.WriteString("The URLs below return plain text: `/f/` a file, `/s/` the files under a directory, one per line, and `/c/` the content of every file under a directory at once.\n\n")
+
+	b.WriteString("## Key files\n\n")
+	listed := 0
+	for _, file := range files {
+		if file.Kind < 0 || listed == maxKeyFiles {
+			break
+		}
+		fmt.Fprintf(&b, "- [%s](%s/f/%s%s): %s\n", file.Path, base, project, file.Path, keyFileKinds[file.Kind])
+		listed++
+	}
+	if listed == 0 {
+		b.WriteString("- No documentation, manifest or entry point found\n")
+	}
+
+	b.WriteString("\n## Project\n\n")
+	fmt.Fprintf(&b, "- [Structure](%s/s/%s/): every directory and file\n", base, project)
+	fmt.Fprintf(&b, "- [All file content](%s/c/%s/?format=markdown): every file at once\n", base, project)
+	fmt.Fprintf(&b, "- [Inlined content](%s/%s/llms-full.txt): the key files and as many others as fit in ~%s tokens\n", base, project, formatCount(llmsFullDefaultBudget))
+	fmt.Fprintf(&b, "- [Statistics](%s/stats/%s): files, lines and languages, as JSON\n", base, project)
+
+	if len(config.Bundles) > 0 {
+		b.WriteString("\n## Bundles\n\n")
+		for _, bundle := range config.Bundles {
+			description := bundle.Description
+			if description == "" {
+				description = "curated files"
+			}
+			fmt.Fprintf(&b, "- [%s](%s/bundle/%s/%s): %s\n", bundle.Name, base, project, url.PathEscape(bundle.Name), description)
+		}
+	}
+
+	// The directories are measured from the stats of the header, not again
+	entries, err := listDirectory(config, project, "", false)
+	if err != nil {
+		return "", err
+	}
+	var dirs []treeEntry
+	for _, entry := range entries {
+		if entry.Type == "dir" {
+			dirs = append(dirs, entry)
+		}
+	}
+	if len(dirs) > 0 {
+		b.WriteString("\n## Optional\n\n")
+		for _, dir := range dirs {
+			var total treeStats
+			if dirStats := stats.topDirectories[dir.Path]; dirStats != nil {
+				total = *dirStats
+			}
+			total.summarize(true)
+			fmt.Fprintf(&b, "- [%s/](%s?format=markdown): %s\n", dir.Path, dir.Links.ContentsURL, total.Summary)
+		}
+	}
+	return b.String(), nil
+}
+
+// buildLlmsFullTxt writes the llms-full.txt of a project: the summary of
+// llms.txt followed by the content of the key files, then of the others by
+// depth, as long as they fit in budget tokens. The files left out are
+// listed with their URLs. With redact, the secrets of the files are masked.
+func buildLlmsFullTxt(config Config, project string, budget int, redact bool) (string, error) {
+	files, err := collectLlmsFiles(config)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if _, err := writeLlmsHeader(&b, config, project, files); err != nil {
+		return "", err
+	}
+
+	var included []contentFile
+	var omitted []string
+	used := 0
+	for _, file := range files {
+		content, err := readContentFile(file.root, file.name, strings.TrimPrefix(file.Path, "/"))
+		if err != nil {
+			return "", err
+		}
+		if content.Skipped != "" {
+			continue
+		}
+		if redact {
+			content.Content, _ = redactText(config, content.Path, content.Content)
+		}
+		tokens := estimateTokens([]byte(content.Content))
+		if used+tokens > budget {
+			omitted = append(omitted, fmt.Sprintf("- [%s](%s/f/%s%s): ~%s tokens\n", file.Path, config.ProjectURL, project, file.Path, formatCount(tokens)))
+			continue
+		}
+		used += tokens
+		included = append(included, content)
+	}
+
+	fmt.Fprintf(&b, "This file inlines %d of the %d text files of the project, ~%s of a budget of %s tokens.\n\n", len(included), len(included)+len(omitted), formatCount(used), formatCount(budget))
+	b.WriteString(formatContents(included, formatMarkdown))
+	if len(omitted) > 0 {
+		b.WriteString("## Omitted files\n\n")
+		for _, line := range omitted {
+			b.WriteString(line)
+		}
+	}
+	return b.String(), nil
+}
+
+// llmsHandler serves /{project}/llms.txt and /{project}/llms-full.txt, the
+// latter taking a token ?budget=
+func llmsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	budget, err := parseTokenBudget(r.URL.Query().Get("budget"), llmsFullDefaultBudget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	full := strings.HasSuffix(r.URL.Path, "/llms-full.txt")
+	redact := full && shouldRedact(r)
+	variant := "llms"
+	if full {
+		variant = fmt.Sprintf("llms-full:%d:%t", budget, redact)
+	}
+	if etag, lastModified, err := treeETag(selectedConfig, "", variant); err == nil {
+		if checkNotModified(w, r, etag, lastModified) {
+			return
+		}
+	}
+
+	var text string
+	if full {
+		text, err = buildLlmsFullTxt(selectedConfig, project, budget, redact)
+	} else {
+		text, err = buildLlmsTxt(selectedConfig, project)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Write([]byte(text))
+}
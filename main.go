@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type GeneralSettings struct {
@@ -20,6 +22,44 @@ type GeneralSettings struct {
 	InclusiveExtensions            string `json:"inclusive_extensions"`
 	ExclusiveExtensions            string `json:"exclusive_extensions"`
 	ExclusiveFolders               string `json:"exclusive_folders"`
+	MaxFileSize                    int64  `json:"max_file_size"`
+	CacheMaxBytes                  int64  `json:"cache_max_bytes"`
+	Compression                    bool   `json:"compression"`
+	CompressionMinSize             int    `json:"compression_min_size"`
+	// The server as reached from the Internet, and how it describes itself in
+	// /.well-known/ai-plugin.json
+	PublicURL          string `json:"public_url,omitempty"`
+	PluginName         string `json:"plugin_name,omitempty"`
+	PluginDescription  string `json:"plugin_description,omitempty"`
+	PluginLogoURL      string `json:"plugin_logo_url,omitempty"`
+	PluginContactEmail string `json:"plugin_contact_email,omitempty"`
+	PluginLegalInfoURL string `json:"plugin_legal_info_url,omitempty"`
+	// OpenAI-compatible API computing the embeddings of /semantic, such as
+	// http://localhost:11434/v1; without it they are computed locally
+	EmbeddingURL    string `json:"embedding_url,omitempty"`
+	EmbeddingModel  string `json:"embedding_model,omitempty"`
+	EmbeddingAPIKey string `json:"embedding_api_key,omitempty"`
+	// Reranking API reordering the best results of /retrieve, such as a
+	// llama.cpp or Infinity server; without it they keep their fused order
+	RerankURL    string `json:"rerank_url,omitempty"`
+	RerankModel  string `json:"rerank_model,omitempty"`
+	RerankAPIKey string `json:"rerank_api_key,omitempty"`
+	// OpenAI-compatible chat API answering /ask, such as a llama.cpp or
+	// Ollama server; without it /ask is disabled
+	ChatURL    string `json:"chat_url,omitempty"`
+	ChatModel  string `json:"chat_model,omitempty"`
+	ChatAPIKey string `json:"chat_api_key,omitempty"`
+	// Lets clients outside the local network use /ask, each question being
+	// a call to the chat model
+	AskExternalClients bool `json:"ask_external_clients,omitempty"`
+	// Where the search indexes are kept between restarts, data by default
+	DataDir string `json:"data_dir,omitempty"`
+	// When secrets are masked in served content: external, for requests
+	// from outside the local network by their address, always or never. By
+	// default external, or always when public_url or a project_url isn't on
+	// the local network, as a reverse proxy or tunnel makes every request
+	// look local.
+	RedactSecrets string `json:"redact_secrets,omitempty"`
 }
 
 var generalSettings GeneralSettings
@@ -32,6 +72,34 @@ type Config struct {
 	ExclusiveExtensions string `json:"exclusive_extensions,omitempty"`
 	ExclusiveFolders    string `json:"exclusive_folders,omitempty"`
 	ExclusiveFiles      string `json:"exclusive_files,omitempty"`
+	MaxFileSize         int64  `json:"max_file_size,omitempty"`
+	// Set instead of root_path for a project spanning several directories
+	Roots []RootConfig `json:"roots,omitempty"`
+	// Named file sets served at /bundle/{project}/{name}
+	Bundles []BundleConfig `json:"bundles,omitempty"`
+	// Regular expressions of secrets masked along with the built-in ones
+	RedactPatterns []string `json:"redact_patterns,omitempty"`
+}
+
+// RootConfig is a named directory of a project with several roots. The
+// filters it leaves empty are taken from the project.
+type RootConfig struct {
+	Name                string `json:"name"`
+	RootPath            string `json:"root_path"`
+	InclusiveExtensions string `json:"inclusive_extensions,omitempty"`
+	ExclusiveExtensions string `json:"exclusive_extensions,omitempty"`
+	ExclusiveFolders    string `json:"exclusive_folders,omitempty"`
+	ExclusiveFiles      string `json:"exclusive_files,omitempty"`
+	MaxFileSize         int64  `json:"max_file_size,omitempty"`
+}
+
+// BundleConfig is a curated set of files of a project. Each path is a file,
+// a directory or a glob, where ** matches any number of directories. A file
+// or glob can be followed by a line range such as ":10-80" or ":120-".
+type BundleConfig struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Paths       []string `json:"paths"`
 }
 
 var configs map[string]Config
@@ -113,13 +181,28 @@ func projectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	selectedConfig = configs[project+".json"]
-	dirPath := selectedConfig.RootPath
+	// Measuring reads every file below each directory, so it is only done
+	// when asked for
+	annotate := r.URL.Query().Get("annotate") == "true"
+	entries, err := listDirectory(selectedConfig, project, "", annotate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rootStats := ""
+	sizesLink := fmt.Sprintf("<a href='/p/%s?annotate=true' title=\"Show the files, size, lines and tokens of every directory\"><i class='fas fa-ruler' style='color:#CD853F'></i> Show sizes</a>", project)
+	if annotate {
+		rootStats = sumEntries(entries).Summary
+		sizesLink = fmt.Sprintf("<a href='/p/%s' title=\"Hide the sizes, for faster loading\"><i class='fas fa-ruler' style='color:#CD853F'></i> Hide sizes</a>", project)
+	}
 
 	// Generate links for the root directory
 	dirStructureLink := fmt.Sprintf("/s/%s/", project)
 	dirContentsLink := fmt.Sprintf("/c/%s/", project)
 	dirStructureUrl := fmt.Sprintf("%s%s", selectedConfig.ProjectURL, dirStructureLink)
 	dirContentsUrl := fmt.Sprintf("%s%s", selectedConfig.ProjectURL, dirContentsLink)
+	statsLink := fmt.Sprintf("/stats/%s", project)
+	statsUrl := fmt.Sprintf("%s%s", selectedConfig.ProjectURL, statsLink)
 
 	fmt.Fprintln(w, `<!DOCTYPE html>
 <html lang="en">
@@ -131,24 +214,36 @@ func projectHandler(w http.ResponseWriter, r *http.Request) {
 <link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/5.15.3/css/all.min.css">
 <script>
     var appendTimestamp = `+fmt.Sprintf("%t", generalSettings.TimeStamp)+`;
+    var annotateTree = `+fmt.Sprintf("%t", annotate)+`;
 </script>
 </head>
 <body>
 <a href="/" class="back-button"><i class="fas fa-arrow-left"></i> Projects</a>
 <h1>`+selectedConfig.ProjectName+`</h1>
+<div class="project-links">
+    <a href='`+statsLink+`?format=html' target='_blank' title="Display project statistics"><i class='fas fa-chart-bar' style='color:#6495ED'></i> Statistics</a>
+    <button class='copy-button' data-url='`+statsUrl+`' title="Copy statistics URL"><i class='fas fa-copy' style='color:#20B2AA'></i></button>
+    `+sizesLink+`
+</div>
+`+bundleLinks(selectedConfig, project)+`<div class="basket-bar">
+    <span class="basket-count">No files selected</span>
+    <button class="basket-create" data-project='`+project+`' disabled title="Get one file-content URL for the checked files and directories"><i class='fas fa-shopping-basket'></i> Create basket URL</button>
+    <span class="basket-result"></span>
+</div>
 <div class="tree-view">
         <ul>
             <li class="root-item expanded">
                 <div class='item'>
-                    <span>`+selectedConfig.ProjectName+`</span>
+                    <span>`+selectedConfig.ProjectName+`</span> <small class='stats'>`+rootStats+`</small>
                     <a href='`+dirStructureLink+`' target='_blank' class='buttons' title="Display whole structure"><i class='fas fa-sitemap' style='color:orange'></i></a>
                     <a href='`+dirContentsLink+`' target='_blank' class='buttons' title="Display all file content"><i class='fas fa-file-code' style='color:#6495ED'></i></a>
                     <button class='copy-button buttons' data-url='`+dirStructureUrl+`' title="Copy structure URL"><i class='fas fa-copy' style='color:#20B2AA'></i></button>
                     <button class='copy-button buttons' data-url='`+dirContentsUrl+`' title="Copy file-content URL"><i class='fas fa-copy' style='color:green'></i></button>
+                    <a href='/z/`+project+`/' target='_blank' class='buttons' title="Download all file content as zip"><i class='fas fa-file-archive' style='color:#CD853F'></i></a>
                 </div>
                 <ul>`)
 
-	writeDirectory(w, dirPath, dirPath, project)
+	writeDirectory(w, entries, annotate)
 
 	fmt.Fprintln(w, `</ul></li>
         </ul>
@@ -170,13 +265,39 @@ func fileViewHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	selectedConfig = configs[project+".json"]
-	fullPath := filepath.Join(selectedConfig.RootPath, path)
+	root, name, err := resolveFile(selectedConfig, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	data, err := os.ReadFile(fullPath)
+	info, err := fs.Stat(root.FS, name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	redact := shouldRedact(r)
+	etag := fileETag(info)
+	if redact {
+		etag = redactedETag(etag)
+	}
+	if checkNotModified(w, r, etag, info.ModTime()) {
+		return
+	}
+
+	data, skipped, err := root.readTextFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if skipped != "" {
+		http.Error(w, "File not shown: "+skipped, http.StatusUnprocessableEntity)
+		return
+	}
+	if redact {
+		text, _ := redactText(selectedConfig, "/"+path, string(data))
+		data = []byte(text)
+	}
 
 	fmt.Fprintln(w, `<!DOCTYPE html>
 <html lang="en">
@@ -202,18 +323,70 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	selectedConfig = configs[project+".json"]
-	fullPath := filepath.Join(selectedConfig.RootPath, path)
+	root, name, err := resolveFile(selectedConfig, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	data, err := os.ReadFile(fullPath)
+	info, err := fs.Stat(root.FS, name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	redact := shouldRedact(r)
+	etag := fileETag(info)
+	if redact {
+		etag = redactedETag(etag)
+	}
+	if checkNotModified(w, r, etag, info.ModTime()) {
+		return
+	}
 
-	// Set the content type to plain text with UTF-8 charset
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	maxFileSize := root.Filter.MaxFileSize
+	if maxFileSize > 0 && info.Size() > maxFileSize {
+		http.Error(w, fmt.Sprintf("File not shown: %d bytes exceeds max_file_size of %d bytes", info.Size(), maxFileSize), http.StatusUnprocessableEntity)
+		return
+	}
+
+	data, err := fs.ReadFile(root.FS, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if redact && !isBinary(data) {
+		text, _ := redactText(selectedConfig, "/"+path, string(data))
+		data = []byte(text)
+	}
+
+	// ?lines=10-80 serves only those lines, as cited by /ask-context
+	if lines := r.URL.Query().Get("lines"); lines != "" {
+		startLine, endLine, err := parseLineRange(lines)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if isBinary(data) {
+			http.Error(w, "Line ranges only apply to text files", http.StatusUnprocessableEntity)
+			return
+		}
+		slice := sliceLines(contentFile{Path: path, Content: string(data)}, startLine, endLine)
+		if slice.Skipped != "" {
+			http.Error(w, "Invalid line range: "+slice.Skipped, http.StatusUnprocessableEntity)
+			return
+		}
+		data = []byte(slice.Content)
+	}
+
+	// Set the content type to plain text with UTF-8 charset, unless it is a binary file
+	if isBinary(data) {
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	}
 
-	// Write the file content as plain text
+	// Write the file content
 	w.Write(data)
 }
 
@@ -228,13 +401,39 @@ func jsonFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	selectedConfig = configs[project+".json"]
-	fullPath := filepath.Join(selectedConfig.RootPath, path)
+	root, name, err := resolveFile(selectedConfig, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	data, err := os.ReadFile(fullPath)
+	info, err := fs.Stat(root.FS, name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	redact := shouldRedact(r)
+	etag := fileETag(info)
+	if redact {
+		etag = redactedETag(etag)
+	}
+	if checkNotModified(w, r, etag, info.ModTime()) {
+		return
+	}
+
+	data, skipped, err := root.readTextFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if skipped != "" {
+		http.Error(w, "File not shown: "+skipped, http.StatusUnprocessableEntity)
+		return
+	}
+	if redact {
+		text, _ := redactText(selectedConfig, "/"+path, string(data))
+		data = []byte(text)
+	}
 
 	lines := strings.Split(string(data), "\n")
 	jsonData := make([]map[string]interface{}, len(lines))
@@ -245,7 +444,7 @@ func jsonFileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	fileName := filepath.Base(fullPath)          // Get only the file name
+	fileName := filepath.Base(name)              // Get only the file name
 	relativePath := "/" + filepath.ToSlash(path) // Ensure path starts with "/"
 
 	response := map[string]interface{}{
@@ -269,70 +468,122 @@ func dirStructureHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	selectedConfig = configs[project+".json"]
-	fullPath := filepath.Join(selectedConfig.RootPath, path)
+	if _, _, err := resolvePath(selectedConfig, path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// Get the configurations from the selected project or from general settings
-	inclusiveExtensions := strings.Split(selectedConfig.InclusiveExtensions, ",")
-	if inclusiveExtensions[0] == "" {
-		inclusiveExtensions = strings.Split(generalSettings.InclusiveExtensions, ",")
+	// The annotated mode shows sizes, lines and token estimates
+	annotate := r.URL.Query().Get("annotate") == "true"
+	variant := "structure"
+	if annotate {
+		variant = "structure:annotated"
 	}
-	exclusiveExtensions := strings.Split(selectedConfig.ExclusiveExtensions, ",")
-	if exclusiveExtensions[0] == "" {
-		exclusiveExtensions = strings.Split(generalSettings.ExclusiveExtensions, ",")
+	if etag, lastModified, err := treeETag(selectedConfig, path, variant); err == nil {
+		if checkNotModified(w, r, etag, lastModified) {
+			return
+		}
 	}
-	exclusiveFolders := strings.Split(selectedConfig.ExclusiveFolders, ",")
-	if exclusiveFolders[0] == "" {
-		exclusiveFolders = strings.Split(generalSettings.ExclusiveFolders, ",")
+
+	structure, err := buildStructure(selectedConfig, path, annotate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Write([]byte(structure))
+}
+
+// buildStructure lists the directories and files under path the way /s
+// shows them. Annotated, it adds the size, lines and tokens of each of them
+// and a total.
+func buildStructure(config Config, path string, annotate bool) (string, error) {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	root, name, err := resolvePath(config, path)
+	if err != nil {
+		return "", err
+	}
+
+	dirLine := func(indent, dirRelativePath string, dirStats treeStats) string {
+		if annotate {
+			dirStats.summarize(true)
+			return fmt.Sprintf("%s[/%s] (%s)\n", indent, dirRelativePath, dirStats.Summary)
+		}
+		return fmt.Sprintf("%s[/%s]\n", indent, dirRelativePath)
 	}
-	exclusiveFiles := strings.Split(selectedConfig.ExclusiveFiles, ",")
 
-	var buildDirStructure func(string, string, int) string
-	buildDirStructure = func(currentPath, relativePath string, level int) string {
-		files, err := os.ReadDir(currentPath)
+	var buildDirStructure func(*projectRoot, string, string, int) (string, treeStats)
+	buildDirStructure = func(root *projectRoot, currentName, relativePath string, level int) (string, treeStats) {
+		var total treeStats
+		filter := root.Filter
+		files, err := root.readDir(currentName)
 		if err != nil {
-			return "Error reading directory: " + err.Error() + "\n"
+			return "Error reading directory: " + err.Error() + "\n", total
 		}
 
 		var structure string
 		indent := strings.Repeat("  ", level)
 		for _, file := range files {
-			if !generalSettings.ShowHidden && strings.HasPrefix(file.Name(), ".") {
+			if filter.skipHidden(file.Name()) {
 				continue // Skip hidden files and directories
 			}
 			fileName := file.Name()
-			if contains(exclusiveFiles, fileName) {
+			if contains(filter.ExclusiveFiles, fileName) {
 				continue // Skip exclusive files
 			}
 			if file.IsDir() {
 				dirRelativePath := filepath.Join(relativePath, fileName)
 				dirRelativePath = filepath.ToSlash(filepath.Clean(dirRelativePath))
-				fileRelativePathToCompare := dirRelativePath
-				if !strings.HasPrefix(fileRelativePathToCompare, "/") {
-					fileRelativePathToCompare = fmt.Sprintf("/%s", fileRelativePathToCompare)
-				}
-				if checkExclusiveDir(exclusiveFolders, fileRelativePathToCompare, fileName) {
+				if filter.excludeDir(dirRelativePath, fileName) {
 					continue
 				}
-				structure += fmt.Sprintf("%s[/%s]\n", indent, dirRelativePath)
-				structure += buildDirStructure(filepath.Join(currentPath, fileName), dirRelativePath, level+1)
-			} else {
-				ext := filepath.Ext(fileName)
-				if len(ext) > 0 {
-					ext = ext[1:] // Remove the leading "."
-				}
-				if (len(inclusiveExtensions) == 0 || inclusiveExtensions[0] == "*" || contains(inclusiveExtensions, ext)) &&
-					(len(exclusiveExtensions) == 0 || !contains(exclusiveExtensions, ext)) {
-					fileRelativePath := filepath.Join(relativePath, fileName)
-					fileRelativePath = filepath.ToSlash(fileRelativePath)
+				dirStructure, dirStats := buildDirStructure(root, filepath.ToSlash(filepath.Join(currentName, fileName)), dirRelativePath, level+1)
+				total.add(dirStats)
+				structure += dirLine(indent, dirRelativePath, dirStats)
+				structure += dirStructure
+			} else if filter.includeFile(fileName) {
+				fileRelativePath := filepath.Join(relativePath, fileName)
+				fileRelativePath = filepath.ToSlash(fileRelativePath)
+				if annotate {
+					info, err := file.Info()
+					if err != nil {
+						continue // Removed while listing
+					}
+					stats := measureFile(root, filepath.ToSlash(filepath.Join(currentName, fileName)), info.Size(), info.ModTime())
+					total.add(stats)
+					structure += fmt.Sprintf("%s/%s (%s, modified %s)\n", indent, fileRelativePath, stats.Summary, info.ModTime().UTC().Format(time.RFC3339))
+				} else {
 					structure += fmt.Sprintf("%s/%s\n", indent, fileRelativePath)
 				}
 			}
 		}
-		return structure
+		return structure, total
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-	w.Write([]byte(buildDirStructure(fullPath, path, 0)))
+	var structure string
+	var total treeStats
+	if root != nil {
+		structure, total = buildDirStructure(root, name, path, 0)
+	} else {
+		// Each root of the project is a top-level directory
+		roots, err := projectRoots(config)
+		if err != nil {
+			return "", err
+		}
+		for i := range roots {
+			root := &roots[i]
+			rootStructure, rootStats := buildDirStructure(root, ".", root.Name, 1)
+			total.add(rootStats)
+			structure += dirLine("", root.Name, rootStats)
+			structure += rootStructure
+		}
+	}
+	if annotate {
+		total.summarize(true)
+		structure += fmt.Sprintf("\nTotal: %s\n", total.Summary)
+	}
+	return structure, nil
 }
 
 func dirContentsHandler(w http.ResponseWriter, r *http.Request) {
@@ -345,183 +596,78 @@ func dirContentsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	selectedConfig = configs[project+".json"]
-	fullPath := filepath.Join(selectedConfig.RootPath, path)
-
-	// Get the configurations from the selected project or from general settings
-	inclusiveExtensions := strings.Split(selectedConfig.InclusiveExtensions, ",")
-	if inclusiveExtensions[0] == "" {
-		inclusiveExtensions = strings.Split(generalSettings.InclusiveExtensions, ",")
-	}
-	exclusiveExtensions := strings.Split(selectedConfig.ExclusiveExtensions, ",")
-	if exclusiveExtensions[0] == "" {
-		exclusiveExtensions = strings.Split(generalSettings.ExclusiveExtensions, ",")
-	}
-	exclusiveFolders := strings.Split(selectedConfig.ExclusiveFolders, ",")
-	if exclusiveFolders[0] == "" {
-		exclusiveFolders = strings.Split(generalSettings.ExclusiveFolders, ",")
+	format, err := parseContentsFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	exclusiveFiles := strings.Split(selectedConfig.ExclusiveFiles, ",")
 
-	var readDirContents func(string, string) (string, error)
-	readDirContents = func(currentPath, relativePath string) (string, error) {
-		var contents string
-		files, err := os.ReadDir(currentPath)
-		if err != nil {
-			return "", err
-		}
+	selectedConfig = configs[project+".json"]
 
-		for _, file := range files {
-			if !generalSettings.ShowHidden && strings.HasPrefix(file.Name(), ".") {
-				continue // Skip hidden files and directories
-			}
-			fileName := file.Name()
-			if contains(exclusiveFiles, fileName) {
-				continue // Skip exclusive files
-			}
-			filePath := filepath.Join(currentPath, fileName)
-			fileRelativePath := filepath.Join(relativePath, fileName)
-			fileRelativePath = filepath.ToSlash(filepath.Clean(fileRelativePath))
-			if file.IsDir() {
-				fileRelativePathToCompare := fileRelativePath
-				if !strings.HasPrefix(fileRelativePathToCompare, "/") {
-					fileRelativePathToCompare = fmt.Sprintf("/%s", fileRelativePathToCompare)
-				}
-				if checkExclusiveDir(exclusiveFolders, fileRelativePathToCompare, fileName) {
-					continue
-				}
-				dirContents, err := readDirContents(filePath, fileRelativePath)
-				if err != nil {
-					return "", err
-				}
-				contents += dirContents
-			} else {
-				ext := filepath.Ext(fileName)
-				if len(ext) > 0 {
-					ext = ext[1:] // Remove the leading "."
-				}
-				if (len(inclusiveExtensions) == 0 || inclusiveExtensions[0] == "*" || contains(inclusiveExtensions, ext)) &&
-					(len(exclusiveExtensions) == 0 || !contains(exclusiveExtensions, ext)) {
-					fileData, err := os.ReadFile(filePath)
-					if err != nil {
-						return "", err
-					}
-					contents += fmt.Sprintf("---------------\nFile: /%s:\n\n%s\n\n", fileRelativePath, string(fileData))
-				}
-			}
+	redact := shouldRedact(r)
+	variant := "contents:" + format
+	if redact {
+		variant += ":redacted"
+	}
+	if etag, lastModified, err := treeETag(selectedConfig, path, variant); err == nil {
+		if checkNotModified(w, r, etag, lastModified) {
+			return
 		}
-		return contents, nil
 	}
 
-	dirContents, err := readDirContents(fullPath, path)
+	files, err := collectDirContents(selectedConfig, path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-	w.Write([]byte(dirContents))
-}
-
-func writeDirectory(w http.ResponseWriter, path string, rootPath string, project string) {
-	files, err := os.ReadDir(path)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if redact {
+		redactContents(selectedConfig, files)
 	}
 
-	// Separate directories and files
-	var dirs []os.DirEntry
-	var filesOnly []os.DirEntry
+	skipped := 0
 	for _, file := range files {
-		// Use the show_hidden property from the general settings
-		if !generalSettings.ShowHidden && strings.HasPrefix(file.Name(), ".") {
-			continue
-		}
-
-		if file.IsDir() {
-			dirs = append(dirs, file)
-		} else {
-			filesOnly = append(filesOnly, file)
+		if file.Skipped != "" {
+			skipped++
 		}
 	}
+	w.Header().Set("Content-Type", contentsContentType(format))
+	w.Header().Set("X-Skipped-Files", strconv.Itoa(skipped))
+	w.Write([]byte(formatContents(files, format)))
+}
 
-	// Optionally sort dirs and filesOnly slices alphabetically
-	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
-	sort.Slice(filesOnly, func(i, j int) bool { return filesOnly[i].Name() < filesOnly[j].Name() })
-
-	// Get the configurations from the selected project or from general settings
-	inclusiveExtensions := strings.Split(selectedConfig.InclusiveExtensions, ",")
-	if inclusiveExtensions[0] == "" {
-		inclusiveExtensions = strings.Split(generalSettings.InclusiveExtensions, ",")
-	}
-	exclusiveExtensions := strings.Split(selectedConfig.ExclusiveExtensions, ",")
-	if exclusiveExtensions[0] == "" {
-		exclusiveExtensions = strings.Split(generalSettings.ExclusiveExtensions, ",")
-	}
-	exclusiveFolders := strings.Split(selectedConfig.ExclusiveFolders, ",")
-	if exclusiveFolders[0] == "" {
-		exclusiveFolders = strings.Split(generalSettings.ExclusiveFolders, ",")
-	}
-
-	exclusiveFiles := strings.Split(selectedConfig.ExclusiveFiles, ",")
-
-	// Inside the writeDirectory function
-	for _, dir := range dirs {
-		relativePath := strings.TrimPrefix(path, rootPath)
-		dirPath := filepath.ToSlash(filepath.Clean(filepath.Join(relativePath, dir.Name())))
-		if !strings.HasPrefix(dirPath, "/") {
-			dirPath = fmt.Sprintf("/%s", dirPath)
-		}
-		if checkExclusiveDir(exclusiveFolders, dirPath, dir.Name()) {
-			continue
-		}
-		dirStructureLink := filepath.ToSlash(filepath.Clean(fmt.Sprintf("/s/%s%s", project, dirPath)))
-		dirContentsLink := filepath.ToSlash(filepath.Clean(fmt.Sprintf("/c/%s%s", project, dirPath)))
-		dirStructureUrl := filepath.ToSlash(fmt.Sprintf("%s%s", selectedConfig.ProjectURL, dirStructureLink))
-		dirContentsUrl := filepath.ToSlash(fmt.Sprintf("%s%s", selectedConfig.ProjectURL, dirContentsLink))
-
-		fmt.Fprintf(w, `<li><div class='item'><span>%s</span> 
+// writeDirectory renders one level of the project tree, as returned by
+// listDirectory. Subdirectories are left empty, script.js loads them from
+// /api/tree when they are expanded.
+func writeDirectory(w http.ResponseWriter, entries []treeEntry, annotate bool) {
+	for _, entry := range entries {
+		if entry.Type == "dir" {
+			stats := ""
+			if entry.Stats != nil {
+				stats = entry.Stats.Summary
+			}
+			children := entry.Links.Children
+			if annotate {
+				children += "?annotate=true"
+			}
+			fmt.Fprintf(w, `<li data-children='%s'><div class='item'><input type='checkbox' class='select-box' data-path='%s' title="Add to basket"><span>%s</span> <small class='stats'>%s</small>
 			<a href='%s' target='_blank' class='buttons' title="Display structure in directory"><i class='fas fa-sitemap' style='color:orange'></i></a>
 			<a href='%s' target='_blank' class='buttons' title="Display file content in directory"><i class='fas fa-file-code' style='color:#6495ED'></i></a>
 			<button class='copy-button buttons' data-url='%s' title="Copy structure URL"><i class='fas fa-copy' style='color:#20B2AA'></i></button>
 			<button class='copy-button buttons' data-url='%s' title="Copy file-content URL"><i class='fas fa-copy' style='color:green'></i></button>
-		</div><ul>`, dir.Name(), dirStructureLink, dirContentsLink, dirStructureUrl, dirContentsUrl)
-		writeDirectory(w, filepath.Join(path, dir.Name()), rootPath, project) // Recursive call
-		fmt.Fprintln(w, "</ul></li>")
-	}
-
-	// Process files
-	for _, file := range filesOnly {
-		if contains(exclusiveFiles, file.Name()) {
-			continue // Skip exclusive files
-		}
-		ext := filepath.Ext(file.Name()) // Get file extension without the leading "."
-
-		// when ext not empty, remove "."
-		if len(ext) > 0 {
-			ext = ext[1:]
+			<a href='%s' target='_blank' class='buttons' title="Download file content as zip"><i class='fas fa-file-archive' style='color:#CD853F'></i></a>
+		</div><ul></ul></li>`, children, entry.Path, entry.Name, stats, entry.Links.Structure, entry.Links.Contents, entry.Links.StructureURL, entry.Links.ContentsURL, entry.Links.Zip)
+			fmt.Fprintln(w)
+			continue
 		}
 
-		if (len(inclusiveExtensions) == 0 || inclusiveExtensions[0] == "*" || contains(inclusiveExtensions, ext)) &&
-			(len(exclusiveExtensions) == 0 || !contains(exclusiveExtensions, ext)) {
-			relativePath := strings.TrimPrefix(filepath.Join(path, file.Name()), rootPath)
-			relativePath = filepath.ToSlash(relativePath)
-
-			fileLink := fmt.Sprintf("f/%s%s", project, relativePath)
-			fileViewLink := fmt.Sprintf("v/%s%s", project, relativePath)
-
-			url := fmt.Sprintf("%s/%s", selectedConfig.ProjectURL, fileLink)
-			info := fmt.Sprintf("%s: %s", file.Name(), url)
-			jsonLink := fmt.Sprintf("%s/j/%s%s", selectedConfig.ProjectURL, project, relativePath)
-			fmt.Fprintf(w, `<li><div class='item'>
-				<a href='/%s' target='_blank' title="Display in internal URL">%s</a>
+		fmt.Fprintf(w, `<li><div class='item'>
+				<input type='checkbox' class='select-box' data-path='%s' title="Add to basket">
+				<a href='%s' target='_blank' title="Display in internal URL">%s</a>
 				<a href='%s' target='_blank' class='buttons' title="Display in external URL"><i class='fas fa-external-link-alt' style='color:orange'></i></a>
 				<button class='copy-button buttons' data-url='%s' title="Copy external URL"><i class='fas fa-copy' style='color:#20B2AA'></i></button>
 				<button class='copy-button-info buttons' data-info='%s' title="Copy external URL with path"><i class='fas fa-copy'></i></button>
 				<a href='%s' target='_blank' class='buttons' title="Display content in JSON with line numnbers"><i class='fas fa-file-code' style='color:#87CEFA'></i></a>
-			</div></li>`, fileViewLink, file.Name(), url, url, info, jsonLink)
-		}
+			</div></li>`, entry.Path, entry.Links.View, entry.Name, entry.Links.FileURL, entry.Links.FileURL, entry.Links.Info, entry.Links.JSONURL)
 	}
 }
 
@@ -548,23 +694,141 @@ func checkExclusiveDir(exclusiveFolders []string, relativePath string, dirName s
 	return isExcluded
 }
 
+// route is an endpoint of the server. Those with an OperationID are
+// described in /openapi.json, which is generated from this table.
+type route struct {
+	Path        string // gorilla/mux template
+	Handler     http.HandlerFunc
+	Method      string // any method when empty
+	OperationID string
+	Summary     string
+	Query       []queryParam
+	ContentType string // of a successful response
+}
+
+// queryParam is a query parameter of a route
+type queryParam struct {
+	Name        string
+	Description string
+	Type        string // JSON schema type
+	Enum        []string
+	Required    bool
+}
+
+func routes() []route {
+	return []route{
+		{Path: "/", Handler: projectHandler},
+		{
+			Path: "/p/{project_json_name}", Handler: projectHandler,
+			OperationID: "getProjectPage", Summary: "Project page with the file tree and the links to its content",
+			ContentType: "text/html",
+		},
+		{Path: "/v/{project_json_name}/{relativePath:.*}", Handler: fileViewHandler},
+		{
+			Path: "/f/{project_json_name}/{relativePath:.*}", Handler: fileHandler,
+			OperationID: "getFile", Summary: "Content of a file",
+			Query: []queryParam{
+				{Name: "lines", Description: "Range of lines to return, as 10-80, or 10- up to the end", Type: "string"},
+			},
+			ContentType: "text/plain",
+		},
+		{
+			Path: "/j/{project_json_name}/{relativePath:.*}", Handler: jsonFileHandler,
+			OperationID: "getFileLines", Summary: "Content of a file as JSON, with the number of every line",
+			ContentType: "application/json",
+		},
+		{
+			Path: "/s/{project_json_name}/{relativePath:.*}", Handler: dirStructureHandler,
+			OperationID: "getStructure", Summary: "Directories and files under a path, one per line, as filtered by the project settings",
+			Query: []queryParam{
+				{Name: "annotate", Description: "Add the size, lines and estimated tokens of every entry", Type: "boolean"},
+			},
+			ContentType: "text/plain",
+		},
+		{
+			Path: "/c/{project_json_name}/{relativePath:.*}", Handler: dirContentsHandler,
+			OperationID: "getContents", Summary: "Content of every file under a path that passes the project filters, at once",
+			Query: []queryParam{
+				{Name: "format", Description: "Output format, text by default", Type: "string", Enum: []string{formatText, formatMarkdown, formatXML, formatJSON}},
+			},
+			ContentType: "text/plain",
+		},
+		{Path: "/z/{project_json_name}/{relativePath:.*}", Handler: zipHandler},
+		{Path: "/b/{project_json_name}", Handler: createBasketHandler, Method: http.MethodPost},
+		{Path: "/b/{project_json_name}/{id}", Handler: basketHandler},
+		{Path: "/bundle/{project_json_name}/{name}", Handler: bundleHandler},
+		{Path: "/api/tree/{project_json_name}/{relativePath:.*}", Handler: treeHandler},
+		{Path: "/stats/{project_json_name}", Handler: statsHandler},
+		{Path: "/stats/{project_json_name}/{relativePath:.*}", Handler: statsHandler},
+		{Path: "/deps/{project_json_name}", Handler: depsHandler},
+		{Path: "/redactions/{project_json_name}", Handler: redactionsHandler},
+		{Path: "/redactions/{project_json_name}/{relativePath:.*}", Handler: redactionsHandler},
+		{Path: "/semantic/{project_json_name}", Handler: semanticHandler},
+		{Path: "/retrieve/{project_json_name}", Handler: retrieveHandler},
+		{
+			Path: "/ask-context/{project_json_name}", Handler: askContextHandler,
+			OperationID: "getAskContext", Summary: "Prompt with the excerpts of the project that best answer a question, each with a citation ID and the URL of its lines",
+			Query: []queryParam{
+				{Name: "q", Description: "The question", Type: "string", Required: true},
+				{Name: "budget", Description: "Most tokens of excerpts, 8000 by default", Type: "integer"},
+				{Name: "format", Description: "Output format, text by default, or json with the citations", Type: "string", Enum: []string{formatText, formatJSON}},
+			},
+			ContentType: "text/plain",
+		},
+		{Path: "/ask/{project_json_name}", Handler: askHandler},
+		{Path: "/{project_json_name}/llms.txt", Handler: llmsHandler},
+		{Path: "/{project_json_name}/llms-full.txt", Handler: llmsHandler},
+		{Path: "/mcp", Handler: mcpHandler},
+		{Path: "/openapi.json", Handler: openAPIHandler},
+		{Path: "/.well-known/ai-plugin.json", Handler: pluginManifestHandler},
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate())
+		case "pack":
+			os.Exit(runPack(os.Args[2:]))
+		case "mcp":
+			os.Exit(runMCP())
+		default:
+			fmt.Println("Unknown command:", os.Args[1])
+			fmt.Println("Usage: MinRAGServer [validate | pack <project> [subpath] | mcp]")
+			os.Exit(2)
+		}
+	}
+
 	err := loadConfigs()
 	if err != nil {
 		fmt.Println("Error loading configs:", err)
 		os.Exit(1)
 	}
+	if generalSettings.CacheMaxBytes > 0 {
+		cache = newContentCache(generalSettings.CacheMaxBytes, configs)
+	}
+	embedder = newEmbedder(generalSettings)
+	reranker = newReranker(generalSettings)
+	chat = newChatClient(generalSettings)
+	baskets, err = loadBaskets(basketsFile)
+	if err != nil {
+		fmt.Println("Error loading baskets:", err)
+	}
 
 	http.Handle("/static/", http.StripPrefix("/static", http.FileServer(http.Dir("static"))))
 	r := mux.NewRouter()
-	r.HandleFunc("/", projectHandler)
-	r.HandleFunc("/p/{project_json_name}", projectHandler)
-	r.HandleFunc("/v/{project_json_name}/{relativePath:.*}", fileViewHandler)
-	r.HandleFunc("/f/{project_json_name}/{relativePath:.*}", fileHandler)
-	r.HandleFunc("/j/{project_json_name}/{relativePath:.*}", jsonFileHandler)
-	r.HandleFunc("/s/{project_json_name}/{relativePath:.*}", dirStructureHandler)
-	r.HandleFunc("/c/{project_json_name}/{relativePath:.*}", dirContentsHandler)
-	http.Handle("/", r)
+	for _, route := range routes() {
+		handler := r.HandleFunc(route.Path, route.Handler)
+		if route.Method != "" {
+			handler.Methods(route.Method)
+		}
+	}
+	if generalSettings.Compression {
+		http.Handle("/", compressHandler(r, generalSettings.CompressionMinSize))
+	} else {
+		http.Handle("/", r)
+	}
 
 	fmt.Println("Server is running on http://localhost:" + generalSettings.ServerPort)
 	http.ListenAndServe(":"+generalSettings.ServerPort, nil)
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MCP protocol version used when the client asks for one we don't know
+const mcpProtocolVersion = "2025-03-26"
+
+var mcpProtocolVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// Resource URIs are minrag://{project}/{path}
+const mcpURIScheme = "minrag"
+
+// Largest message accepted over HTTP
+const maxMCPMessageSize = 4 << 20
+
+// JSON-RPC error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	mcpResourceNotFound   = -32002
+)
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// mcpSession is a client connected over stdio or HTTP. Like the web pages,
+// listing the projects is only allowed to local clients when
+// disable_external_network_browsing is set; reading them is open like /f
+// and /c, with secrets masked as redact_secrets sets for the client.
+type mcpSession struct {
+	browse bool
+	redact bool
+}
+
+// mcpToolArguments holds the arguments of every tool, each tool using some
+type mcpToolArguments struct {
+	Project    string `json:"project"`
+	Path       string `json:"path"`
+	StartLine  int    `json:"start_line"`
+	EndLine    int    `json:"end_line"`
+	Query      string `json:"query"`
+	Regex      bool   `json:"regex"`
+	MaxResults int    `json:"max_results"`
+	Format     string `json:"format"`
+	Annotate   bool   `json:"annotate"`
+}
+
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+	run         func(s *mcpSession, args mcpToolArguments) (string, error)
+}
+
+// mcpSchema builds the JSON schema of a tool's arguments
+func mcpSchema(required []string, properties map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func mcpProperty(kind, description string) map[string]interface{} {
+	return map[string]interface{}{"type": kind, "description": description}
+}
+
+var mcpTools []mcpTool
+
+func init() {
+	project := mcpProperty("string", "Project name, as returned by list_projects")
+	mcpTools = []mcpTool{
+		{
+			Name:        "list_projects",
+			Description: "List the projects served, with their names and URLs",
+			InputSchema: mcpSchema(nil, map[string]interface{}{}),
+			run:         (*mcpSession).listProjects,
+		},
+		{
+			Name:        "get_tree",
+			Description: "Get the directories and files of a project or of a directory in it, one per line, as filtered by the project settings",
+			InputSchema: mcpSchema([]string{"project"}, map[string]interface{}{
+				"project":  project,
+				"path":     mcpProperty("string", "Directory in the project, the whole project by default"),
+				"annotate": mcpProperty("boolean", "Add the size, lines and estimated tokens of every entry"),
+			}),
+			run: (*mcpSession).getTree,
+		},
+		{
+			Name:        "read_file",
+			Description: "Read a text file of a project, or only some of its lines",
+			InputSchema: mcpSchema([]string{"project", "path"}, map[string]interface{}{
+				"project":    project,
+				"path":       mcpProperty("string", "File path in the project"),
+				"start_line": mcpProperty("integer", "First line to read, counting from 1"),
+				"end_line":   mcpProperty("integer", "Last line to read, the end of the file by default"),
+			}),
+			run: (*mcpSession).readFile,
+		},
+		{
+			Name:        "search",
+			Description: "Find the lines of the files of a project containing some text, ignoring case, or matching a regular expression",
+			InputSchema: mcpSchema([]string{"project", "query"}, map[string]interface{}{
+				"project":     project,
+				"query":       mcpProperty("string", "Text or regular expression to look for"),
+				"regex":       mcpProperty("boolean", "Treat the query as a Go regular expression"),
+				"path":        mcpProperty("string", "Directory to search in, the whole project by default"),
+				"max_results": mcpProperty("integer", "Most lines returned, 100 by default"),
+			}),
+			run: (*mcpSession).search,
+		},
+		{
+			Name:        "read_directory_contents",
+			Description: "Read every file of a directory of a project that passes its filters, at once",
+			InputSchema: mcpSchema([]string{"project"}, map[string]interface{}{
+				"project": project,
+				"path":    mcpProperty("string", "Directory in the project, the whole project by default"),
+				"format": map[string]interface{}{
+					"type":        "string",
+					"description": "Output format, text by default",
+					"enum":        []string{formatText, formatMarkdown, formatXML, formatJSON},
+				},
+			}),
+			run: (*mcpSession).readDirectoryContents,
+		},
+	}
+}
+
+// mcpProject returns the config of a project named in the tool arguments
+func mcpProject(project string) (Config, error) {
+	config := configs[strings.TrimSuffix(project, ".json")+".json"]
+	if project == "" || config.ProjectName == "" {
+		return config, fmt.Errorf("invalid project %q", project)
+	}
+	return config, nil
+}
+
+// projectNames returns the names of the projects, sorted
+func projectNames() []string {
+	var names []string
+	for file, config := range configs {
+		if config.ProjectName != "" {
+			names = append(names, strings.TrimSuffix(file, ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *mcpSession) listProjects(args mcpToolArguments) (string, error) {
+	if !s.browse {
+		return "", errors.New("access denied")
+	}
+	type projectInfo struct {
+		Project string   `json:"project"`
+		Name    string   `json:"name"`
+		URL     string   `json:"url"`
+		Bundles []string `json:"bundles,omitempty"`
+	}
+	projects := []projectInfo{}
+	for _, name := range projectNames() {
+		config := configs[name+".json"]
+		info := projectInfo{Project: name, Name: config.ProjectName, URL: config.ProjectURL + "/p/" + name}
+		for _, bundle := range config.Bundles {
+			info.Bundles = append(info.Bundles, bundle.Name)
+		}
+		projects = append(projects, info)
+	}
+	data, err := json.MarshalIndent(projects, "", "  ")
+	return string(data), err
+}
+
+func (s *mcpSession) getTree(args mcpToolArguments) (string, error) {
+	config, err := mcpProject(args.Project)
+	if err != nil {
+		return "", err
+	}
+	return buildStructure(config, args.Path, args.Annotate)
+}
+
+func (s *mcpSession) readFile(args mcpToolArguments) (string, error) {
+	config, err := mcpProject(args.Project)
+	if err != nil {
+		return "", err
+	}
+	if args.StartLine < 0 || args.EndLine < 0 || (args.EndLine != 0 && args.EndLine < args.StartLine) {
+		return "", errors.New("invalid line range")
+	}
+	file, err := readProjectFile(config, args.Path, s.redact)
+	if err != nil {
+		return "", err
+	}
+	if args.EndLine != 0 && args.StartLine == 0 {
+		args.StartLine = 1
+	}
+	file = sliceLines(file, args.StartLine, args.EndLine)
+	if file.Skipped != "" {
+		return "", fmt.Errorf("%s: %s", file.Path, file.Skipped)
+	}
+	return file.Content, nil
+}
+
+// readProjectFile reads a file of a project as /c would include it, masking
+// its secrets when redact is set
+func readProjectFile(config Config, path string, redact bool) (contentFile, error) {
+	path = strings.Trim(path, "/")
+	root, name, err := resolveFile(config, path)
+	if err != nil {
+		return contentFile{}, err
+	}
+	info, err := fs.Stat(root.FS, name)
+	if err != nil {
+		return contentFile{}, err
+	}
+	if info.IsDir() {
+		return contentFile{}, fmt.Errorf("/%s is a directory", path)
+	}
+	file, err := readContentFile(root, name, path)
+	if err != nil {
+		return contentFile{}, err
+	}
+	if file.Skipped != "" {
+		return contentFile{}, fmt.Errorf("%s: %s", file.Path, file.Skipped)
+	}
+	if redact {
+		file.Content, _ = redactText(config, file.Path, file.Content)
+	}
+	return file, nil
+}
+
+func (s *mcpSession) search(args mcpToolArguments) (string, error) {
+	config, err := mcpProject(args.Project)
+	if err != nil {
+		return "", err
+	}
+	if args.MaxResults <= 0 {
+		args.MaxResults = 100
+	}
+	matches, truncated, err := searchProject(config, args.Path, args.Query, args.Regex, args.MaxResults, s.redact)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "No matches", nil
+	}
+	var result strings.Builder
+	for _, match := range matches {
+		fmt.Fprintf(&result, "%s:%d: %s\n", match.Path, match.Line, match.Text)
+	}
+	if truncated {
+		fmt.Fprintf(&result, "(stopped after %d matches)\n", len(matches))
+	}
+	return result.String(), nil
+}
+
+func (s *mcpSession) readDirectoryContents(args mcpToolArguments) (string, error) {
+	config, err := mcpProject(args.Project)
+	if err != nil {
+		return "", err
+	}
+	format, err := parseContentsFormat(args.Format)
+	if err != nil {
+		return "", err
+	}
+	return readDirContents(config, args.Path, format, s.redact)
+}
+
+// handle answers a JSON-RPC message or batch, returning nil when there is
+// nothing to answer
+func (s *mcpSession) handle(message []byte) []byte {
+	message = bytes.TrimSpace(message)
+	if len(message) > 0 && message[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(message, &batch); err != nil {
+			return mcpErrorMessage(jsonrpcParseError, err.Error())
+		}
+		var responses []*jsonrpcResponse
+		for _, item := range batch {
+			if response := s.call(item); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		data, _ := json.Marshal(responses)
+		return data
+	}
+
+	response := s.call(message)
+	if response == nil {
+		return nil
+	}
+	data, _ := json.Marshal(response)
+	return data
+}
+
+func mcpErrorMessage(code int, message string) []byte {
+	data, _ := json.Marshal(jsonrpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &jsonrpcError{Code: code, Message: message}})
+	return data
+}
+
+// call runs one JSON-RPC request. Notifications and responses get no answer.
+func (s *mcpSession) call(message json.RawMessage) *jsonrpcResponse {
+	var request jsonrpcRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		return &jsonrpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &jsonrpcError{Code: jsonrpcParseError, Message: err.Error()}}
+	}
+	if request.Method == "" {
+		if len(request.ID) > 0 {
+			return nil // a response to a request of ours, which we don't send
+		}
+		return &jsonrpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &jsonrpcError{Code: jsonrpcInvalidRequest, Message: "missing method"}}
+	}
+	if len(request.ID) == 0 || string(request.ID) == "null" {
+		return nil // notifications, such as notifications/initialized
+	}
+
+	response := &jsonrpcResponse{JSONRPC: "2.0", ID: request.ID}
+	result, rpcErr := s.dispatch(request.Method, request.Params)
+	if rpcErr != nil {
+		response.Error = rpcErr
+	} else {
+		response.Result = result
+	}
+	return response
+}
+
+func (s *mcpSession) dispatch(method string, params json.RawMessage) (interface{}, *jsonrpcError) {
+	switch method {
+	case "initialize":
+		var p struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(params, &p)
+		version := mcpProtocolVersion
+		if contains(mcpProtocolVersions, p.ProtocolVersion) {
+			version = p.ProtocolVersion
+		}
+		return map[string]interface{}{
+			"protocolVersion": version,
+			"capabilities": map[string]interface{}{
+				"tools":     map[string]interface{}{},
+				"resources": map[string]interface{}{},
+			},
+			"serverInfo":   map[string]string{"name": "MinRAGServer", "version": "1.0"},
+			"instructions": "Call list_projects to find the projects, get_tree to see their files, then read_file, search or read_directory_contents to read them.",
+		}, nil
+
+	case "ping":
+		return map[string]interface{}{}, nil
+
+	case "tools/list":
+		return map[string]interface{}{"tools": mcpTools}, nil
+
+	case "tools/call":
+		var p struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: err.Error()}
+		}
+		for _, tool := range mcpTools {
+			if tool.Name != p.Name {
+				continue
+			}
+			var args mcpToolArguments
+			if len(p.Arguments) > 0 {
+				if err := json.Unmarshal(p.Arguments, &args); err != nil {
+					return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: err.Error()}
+				}
+			}
+			// Tool failures are results, so the model gets to see them
+			text, err := tool.run(s, args)
+			if err != nil {
+				return mcpToolResult(err.Error(), true), nil
+			}
+			return mcpToolResult(text, false), nil
+		}
+		return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: "unknown tool: " + p.Name}
+
+	case "resources/list":
+		if !s.browse {
+			return nil, &jsonrpcError{Code: jsonrpcInvalidRequest, Message: "access denied"}
+		}
+		resources := []map[string]string{}
+		for _, name := range projectNames() {
+			resources = append(resources, map[string]string{
+				"uri":         mcpURIScheme + "://" + name + "/",
+				"name":        configs[name+".json"].ProjectName,
+				"description": "Directories and files of the project",
+				"mimeType":    "text/plain",
+			})
+		}
+		return map[string]interface{}{"resources": resources}, nil
+
+	case "resources/templates/list":
+		return map[string]interface{}{"resourceTemplates": []map[string]string{{
+			"uriTemplate": mcpURIScheme + "://{project}/{+path}",
+			"name":        "Project file",
+			"description": "A file of a project, or the directories and files under a directory",
+			"mimeType":    "text/plain",
+		}}}, nil
+
+	case "resources/read":
+		var p struct {
+			URI string `json:"uri"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: err.Error()}
+		}
+		text, err := readMCPResource(p.URI, s.redact)
+		if err != nil {
+			return nil, &jsonrpcError{Code: mcpResourceNotFound, Message: err.Error()}
+		}
+		return map[string]interface{}{"contents": []map[string]string{{
+			"uri":      p.URI,
+			"mimeType": "text/plain",
+			"text":     text,
+		}}}, nil
+	}
+	return nil, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "method not found: " + method}
+}
+
+func mcpToolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// readMCPResource reads a file of a project, or the structure of a directory
+func readMCPResource(uri string, redact bool) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != mcpURIScheme {
+		return "", fmt.Errorf("unknown resource %s", uri)
+	}
+	config, err := mcpProject(u.Host)
+	if err != nil {
+		return "", err
+	}
+	root, name, err := resolvePath(config, u.Path)
+	if err != nil {
+		return "", err
+	}
+	if root != nil {
+		info, err := fs.Stat(root.FS, name)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			file, err := readProjectFile(config, u.Path, redact)
+			return file.Content, err
+		}
+	}
+	return buildStructure(config, u.Path, false)
+}
+
+// runMCP serves MCP over stdin and stdout, one JSON-RPC message per line,
+// for clients that start the server themselves. It returns the process exit
+// code.
+func runMCP() int {
+	if err := loadConfigs(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configs:", err)
+		return 1
+	}
+	if generalSettings.CacheMaxBytes > 0 {
+		cache = newContentCache(generalSettings.CacheMaxBytes, configs)
+	}
+
+	// The client runs on this machine
+	session := &mcpSession{browse: true, redact: shouldRedactLocal()}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if response := session.handle(line); response != nil {
+				os.Stdout.Write(append(response, '\n'))
+			}
+		}
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading stdin:", err)
+			return 1
+		}
+	}
+}
+
+// mcpHandler serves MCP over the streamable HTTP transport. Every request is
+// answered with plain JSON, the server never opening a stream of its own.
+func mcpHandler(w http.ResponseWriter, r *http.Request) {
+	// Guard against DNS rebinding from pages open in a local browser
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "Invalid origin", http.StatusForbidden)
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMCPMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	session := &mcpSession{browse: !generalSettings.DisableExternalNetworkBrowsing || isLocalIP(ip), redact: shouldRedact(r)}
+	response := session.handle(body)
+	if response == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// treeStats measures a file, or the files /c would include under a
+// directory. Binary and oversized files count in Size but not in Lines or
+// Tokens, since they are left out of the contents.
+type treeStats struct {
+	Files        int       `json:"files,omitempty"`
+	Size         int64     `json:"size"`
+	Lines        int       `json:"lines"`
+	Tokens       int       `json:"tokens"`
+	LastModified time.Time `json:"last_modified"`
+	Summary      string    `json:"summary"`
+}
+
+// estimateTokens approximates the number of tokens of a text for the usual
+// BPE tokenizers, which average about four bytes per token on source code
+func estimateTokens(data []byte) int {
+	return (len(data) + 3) / 4
+}
+
+// measureFile reads a file of a root to count its lines and tokens
+func measureFile(root *projectRoot, name string, size int64, modified time.Time) treeStats {
+	stats := treeStats{Files: 1, Size: size, LastModified: modified}
+	if data, skipped, err := root.readTextFile(name); err == nil && skipped == "" {
+		stats.Lines = countLines(data)
+		stats.Tokens = estimateTokens(data)
+	}
+	stats.summarize(false)
+	return stats
+}
+
+// measureDir rolls up the stats of every file of the project under
+// relativePath that passes the filter
+func measureDir(config Config, relativePath string) (treeStats, error) {
+	var total treeStats
+	err := walkProjectFiles(config, relativePath, func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		total.add(measureFile(root, name, info.Size(), info.ModTime()))
+		return nil
+	})
+	total.summarize(true)
+	return total, err
+}
+
+func (s *treeStats) add(other treeStats) {
+	s.Files += other.Files
+	s.Size += other.Size
+	s.Lines += other.Lines
+	s.Tokens += other.Tokens
+	if other.LastModified.After(s.LastModified) {
+		s.LastModified = other.LastModified
+	}
+}
+
+// summarize fills in the short description shown in the tree view
+func (s *treeStats) summarize(dir bool) {
+	s.Summary = fmt.Sprintf("%s, %d lines, ~%s tokens", formatSize(s.Size), s.Lines, formatCount(s.Tokens))
+	if dir {
+		files := "files"
+		if s.Files == 1 {
+			files = "file"
+		}
+		s.Summary = fmt.Sprintf("%d %s, %s", s.Files, files, s.Summary)
+	}
+}
+
+// formatSize renders a byte count with a binary unit
+func formatSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	}
+	return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
+}
+
+// formatCount renders a large count in thousands or millions
+func formatCount(count int) string {
+	switch {
+	case count < 1000:
+		return fmt.Sprintf("%d", count)
+	case count < 1000000:
+		return fmt.Sprintf("%.1fk", float64(count)/1000)
+	}
+	return fmt.Sprintf("%.1fM", float64(count)/1000000)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Descriptions of the variables of the route templates
+var pathParamDescriptions = map[string]string{
+	"project_json_name": "Project name, the name of its config file without .json",
+	"relativePath":      "Path of a file or directory in the project, which may contain slashes; empty for the whole project",
+}
+
+// A variable of a gorilla/mux template, with its optional pattern
+var routeParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// publicURL is the server's address as reached by the client, from
+// public_url when it is set
+func publicURL(r *http.Request) string {
+	if generalSettings.PublicURL != "" {
+		return strings.TrimSuffix(generalSettings.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// openAPIDocument describes the routes with an operation ID as an OpenAPI 3
+// document
+func openAPIDocument(serverURL string) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, route := range routes() {
+		if route.OperationID == "" {
+			continue
+		}
+
+		parameters := []map[string]interface{}{}
+		for _, match := range routeParamPattern.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        match[1],
+				"in":          "path",
+				"required":    true,
+				"description": pathParamDescriptions[match[1]],
+				"schema":      map[string]string{"type": "string"},
+			})
+		}
+		for _, param := range route.Query {
+			schema := map[string]interface{}{"type": param.Type}
+			if len(param.Enum) > 0 {
+				schema["enum"] = param.Enum
+			}
+			parameters = append(parameters, map[string]interface{}{
+				"name":        param.Name,
+				"in":          "query",
+				"required":    param.Required,
+				"description": param.Description,
+				"schema":      schema,
+			})
+		}
+
+		schema := map[string]string{"type": "string"}
+		if route.ContentType == "application/json" {
+			schema = map[string]string{"type": "object"}
+		}
+		method := strings.ToLower(route.Method)
+		if method == "" {
+			method = "get"
+		}
+		path := routeParamPattern.ReplaceAllString(route.Path, "{$1}")
+		paths[path] = map[string]interface{}{
+			method: map[string]interface{}{
+				"operationId": route.OperationID,
+				"summary":     route.Summary,
+				"parameters":  parameters,
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "OK",
+						"content":     map[string]interface{}{route.ContentType: map[string]interface{}{"schema": schema}},
+					},
+					"400": map[string]interface{}{"description": "Unknown project or invalid parameter"},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]string{
+			"title":       pluginName(),
+			"description": pluginDescription(),
+			"version":     "1.0",
+		},
+		"servers": []map[string]string{{"url": serverURL}},
+		"paths":   paths,
+	}
+}
+
+func pluginName() string {
+	if generalSettings.PluginName != "" {
+		return generalSettings.PluginName
+	}
+	return "MinRAGServer"
+}
+
+func pluginDescription() string {
+	if generalSettings.PluginDescription != "" {
+		return generalSettings.PluginDescription
+	}
+	return "Browse and read the source code of the projects served by MinRAGServer"
+}
+
+// Characters not allowed in name_for_model
+var modelNamePattern = regexp.MustCompile(`[^a-z0-9_]+`)
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(openAPIDocument(publicURL(r)))
+}
+
+// pluginManifestHandler serves /.well-known/ai-plugin.json, pointing at
+// /openapi.json
+func pluginManifestHandler(w http.ResponseWriter, r *http.Request) {
+	modelName := strings.Trim(modelNamePattern.ReplaceAllString(strings.ToLower(pluginName()), "_"), "_")
+	if len(modelName) > 64 {
+		modelName = modelName[:64]
+	}
+	manifest := map[string]interface{}{
+		"schema_version":        "v1",
+		"name_for_human":        pluginName(),
+		"name_for_model":        modelName,
+		"description_for_human": pluginDescription(),
+		"description_for_model": pluginDescription() + ". Call getStructure with an empty relativePath to list the files of a project, then getFile, getFileLines or getContents to read them.",
+		"auth":                  map[string]string{"type": "none"},
+		"api":                   map[string]string{"type": "openapi", "url": publicURL(r) + "/openapi.json"},
+		"logo_url":              generalSettings.PluginLogoURL,
+		"contact_email":         generalSettings.PluginContactEmail,
+		"legal_info_url":        generalSettings.PluginLegalInfoURL,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(manifest)
+}
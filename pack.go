@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runPack writes the combined contents of a project, or of a subpath of it,
+// the same way /c does but without starting the server. It returns the
+// process exit code.
+func runPack(args []string) int {
+	flags := flag.NewFlagSet("pack", flag.ContinueOnError)
+	output := flags.String("o", "", "write to this file instead of stdout")
+	formatFlag := flags.String("format", formatText, "output format: text, markdown, xml or json")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: MinRAGServer pack [-o file] [-format text|markdown|xml|json] <project> [subpath]")
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		flags.Usage()
+		return 2
+	}
+	format, err := parseContentsFormat(*formatFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := loadConfigs(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configs:", err)
+		return 1
+	}
+
+	project := strings.TrimSuffix(positional[0], ".json")
+	config, ok := configs[project+".json"]
+	if !ok || config.ProjectName == "" {
+		fmt.Fprintln(os.Stderr, "Invalid project:", project)
+		return 1
+	}
+	path := ""
+	if len(positional) == 2 {
+		path = strings.Trim(filepath.ToSlash(positional[1]), "/")
+	}
+
+	dirContents, err := readDirContents(config, path, format, shouldRedactLocal())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading contents:", err)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.WriteString(dirContents)
+		return 0
+	}
+	if err := os.WriteFile(*output, []byte(dirContents), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// the positional arguments and returns the positional ones.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
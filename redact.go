@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// When secrets are masked, from the redact_secrets setting. When it isn't
+// set, secrets are masked for requests from outside the local network, or
+// always for a server with a public address.
+const (
+	redactExternal = "external" // for requests from outside the local network
+	redactAlways   = "always"
+	redactNever    = "never"
+)
+
+// Shortest string, and least bits of entropy per character, for the
+// high-entropy detector. Hex digests stay below, base64 keys and tokens above.
+const (
+	minSecretLength  = 24
+	minSecretEntropy = 4.5
+)
+
+// secretDetector finds one kind of secret. When the pattern has a group,
+// only the group is masked, so "password=" stays readable.
+type secretDetector struct {
+	name    string
+	pattern *regexp.Regexp
+	applies func(fileName string) bool // nil for every file
+}
+
+var secretDetectors = []secretDetector{
+	{name: "aws-access-key", pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`)},
+	{name: "aws-secret-key", pattern: regexp.MustCompile(`(?i)aws.{0,20}?(?:secret|private).{0,20}?['"]?\s*[:=]\s*['"]?([A-Za-z0-9/+]{40})\b`)},
+	{name: "jwt", pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`)},
+	// Up to the end of the text as well, for a range of lines cutting a key
+	{name: "private-key", pattern: regexp.MustCompile(`-----BEGIN[A-Z0-9 ]*PRIVATE KEY[A-Z ]*-----(?s:.*?)(?:-----END[A-Z0-9 ]*PRIVATE KEY[A-Z ]*-----|\z)`)},
+	{name: "dotenv", pattern: regexp.MustCompile(`(?m)^[ \t]*(?:export[ \t]+)?[A-Za-z_][A-Za-z0-9_.]*[ \t]*=[ \t]*(\S.*?)[ \t]*$`), applies: isDotenvFile},
+	{name: "high-entropy", pattern: regexp.MustCompile(`[A-Za-z0-9+/_\-]{24,}={0,2}`), applies: func(fileName string) bool { return !contains(lockFileNames, strings.ToLower(fileName)) }},
+}
+
+// Lock files are full of checksums, which look random but aren't secrets
+var lockFileNames = []string{
+	"go.sum", "package-lock.json", "yarn.lock", "pnpm-lock.yaml", "cargo.lock", "poetry.lock",
+	"composer.lock", "gemfile.lock", "pubspec.lock", "packages.lock.json",
+}
+
+// isDotenvFile tells whether a file holds KEY=value settings, as in .env,
+// .env.local or production.env
+func isDotenvFile(fileName string) bool {
+	return fileName == ".env" || strings.HasPrefix(fileName, ".env.") || strings.HasSuffix(fileName, ".env")
+}
+
+// shannonEntropy is the average number of bits of information per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// looksRandom keeps the high-entropy candidates that mix letters and digits
+// and are random enough, leaving out identifiers and the paths of URLs
+func looksRandom(content string, start, end int) bool {
+	s := strings.TrimRight(content[start:end], "=")
+	if len(s) < minSecretLength {
+		return false
+	}
+	var upper, lower, digit bool
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= '0' && r <= '9':
+			digit = true
+		}
+	}
+	return upper && lower && digit && shannonEntropy(s) >= minSecretEntropy && !(strings.Contains(s, "/") && inURL(content, start))
+}
+
+// inURL tells whether the text at start belongs to a URL
+func inURL(content string, start int) bool {
+	wordStart := strings.LastIndexAny(content[:start], " \t\n\"'`()<>[]") + 1
+	return strings.Contains(content[wordStart:start], "://")
+}
+
+var (
+	projectPatternsMu sync.Mutex
+	projectPatterns   = make(map[string]*regexp.Regexp) // compiled redact_patterns, by source
+)
+
+// compileRedactPattern compiles a pattern of redact_patterns once
+func compileRedactPattern(pattern string) (*regexp.Regexp, error) {
+	projectPatternsMu.Lock()
+	defer projectPatternsMu.Unlock()
+	if re, ok := projectPatterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	projectPatterns[pattern] = re
+	return re, nil
+}
+
+// secretFinding is a secret found in a file. The secret itself is never
+// kept, only where it is and how long.
+type secretFinding struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line"`
+	Detector string `json:"detector"`
+	Length   int    `json:"length"`
+	start    int
+	end      int
+}
+
+// findSecrets runs the built-in detectors and the redact_patterns of the
+// project over the content of a file. Overlapping findings are reduced to
+// the first and longest.
+func findSecrets(config Config, filePath, content string) []secretFinding {
+	fileName := path.Base(filePath)
+	var findings []secretFinding
+	add := func(name string, re *regexp.Regexp, check func(content string, start, end int) bool) {
+		for _, match := range re.FindAllStringSubmatchIndex(content, -1) {
+			start, end := match[0], match[1]
+			if len(match) >= 4 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			if start == end || (check != nil && !check(content, start, end)) {
+				continue
+			}
+			findings = append(findings, secretFinding{Path: filePath, Detector: name, Length: end - start, start: start, end: end})
+		}
+	}
+	for _, detector := range secretDetectors {
+		if detector.applies != nil && !detector.applies(fileName) {
+			continue
+		}
+		var check func(content string, start, end int) bool
+		if detector.name == "high-entropy" {
+			check = looksRandom
+		}
+		add(detector.name, detector.pattern, check)
+	}
+	for _, pattern := range config.RedactPatterns {
+		if re, err := compileRedactPattern(pattern); err == nil {
+			add("custom", re, nil)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].start != findings[j].start {
+			return findings[i].start < findings[j].start
+		}
+		return findings[i].end > findings[j].end
+	})
+	kept := findings[:0]
+	end := 0
+	for _, finding := range findings {
+		if finding.start < end {
+			continue
+		}
+		finding.Line = strings.Count(content[:finding.start], "\n") + 1
+		kept = append(kept, finding)
+		end = finding.end
+	}
+	return kept
+}
+
+// redactText masks the secrets of a file, keeping their line breaks so the
+// line numbers don't change
+func redactText(config Config, filePath, content string) (string, []secretFinding) {
+	findings := findSecrets(config, filePath, content)
+	if len(findings) == 0 {
+		return content, nil
+	}
+	var b strings.Builder
+	last := 0
+	for _, finding := range findings {
+		b.WriteString(content[last:finding.start])
+		fmt.Fprintf(&b, "[REDACTED %s]", finding.Detector)
+		b.WriteString(strings.Repeat("\n", strings.Count(content[finding.start:finding.end], "\n")))
+		last = finding.end
+	}
+	b.WriteString(content[last:])
+	return b.String(), findings
+}
+
+// redactContents masks the secrets of the files of a contents dump
+func redactContents(config Config, files []contentFile) {
+	for i, file := range files {
+		if file.Skipped == "" {
+			files[i].Content, _ = redactText(config, file.Path, file.Content)
+		}
+	}
+}
+
+// shouldRedact tells whether secrets are masked in the response to a request
+func shouldRedact(r *http.Request) bool {
+	switch generalSettings.RedactSecrets {
+	case redactAlways:
+		return true
+	case redactNever:
+		return false
+	case "":
+		if isPublished() {
+			return true
+		}
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return !isLocalIP(ip)
+}
+
+// isPublished tells whether the server is reached under a public address,
+// the public_url or the project_url of a project not being on the local
+// network. Such a server is usually behind a reverse proxy or a tunnel on the
+// same host, through which every request comes from a local address.
+func isPublished() bool {
+	urls := []string{generalSettings.PublicURL}
+	for _, config := range configs {
+		urls = append(urls, config.ProjectURL)
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if rawURL == "" || err != nil {
+			continue
+		}
+		if host := u.Hostname(); host != "localhost" && !isLocalIP(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRedactLocal tells whether secrets are masked for a client on this
+// machine, such as the pack command or MCP over stdio
+func shouldRedactLocal() bool {
+	return generalSettings.RedactSecrets == redactAlways
+}
+
+// redactionKey tells what the chunks of the semantic index of a project are
+// masked with, empty when they aren't. They are masked unless redact_secrets
+// is never, as they are sent to the embedding and rerank servers and served
+// to any client.
+func redactionKey(config Config) string {
+	if generalSettings.RedactSecrets == redactNever {
+		return ""
+	}
+	return strings.Join(append([]string{"masked"}, config.RedactPatterns...), "\n")
+}
+
+// redactedETag gives the masked version of a resource its own tag
+func redactedETag(etag string) string {
+	return strings.TrimSuffix(etag, "\"") + "-redacted\""
+}
+
+// redactionsHandler lists the secrets that would be masked under a path of
+// a project, by file and line, without their values
+func redactionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+	relativePath := vars["relativePath"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if generalSettings.DisableExternalNetworkBrowsing && !isLocalIP(ip) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	if _, _, err := resolvePath(selectedConfig, relativePath); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	masked := shouldRedact(r)
+	if etag, lastModified, err := treeETag(selectedConfig, relativePath, fmt.Sprintf("redactions:%t", masked)); err == nil {
+		if checkNotModified(w, r, etag, lastModified) {
+			return
+		}
+	}
+
+	report := struct {
+		Project      string          `json:"project"`
+		Path         string          `json:"path"`
+		Masked       bool            `json:"masked"` // in the content served to this client
+		FilesScanned int             `json:"files_scanned"`
+		Findings     []secretFinding `json:"findings"`
+	}{Project: project, Path: "/" + strings.Trim(relativePath, "/"), Masked: masked, Findings: []secretFinding{}}
+	err := walkProjectFiles(selectedConfig, relativePath, func(root *projectRoot, name, fileRelativePath string, _ fs.DirEntry) error {
+		data, skipped, err := root.readTextFile(name)
+		if err != nil || skipped != "" {
+			return err
+		}
+		report.FilesScanned++
+		report.Findings = append(report.Findings, findSecrets(selectedConfig, "/"+fileRelativePath, string(data))...)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Reciprocal rank fusion adds 1/(rrfK+rank) for each ranking a chunk is in,
+// so being near the top of either ranking counts more than the raw scores,
+// which aren't comparable
+const rrfK = 60
+
+// Chunks taken from the top of each ranking before fusing them, and at least
+// how many of the fused chunks go to the reranker
+const (
+	retrieveCandidates = 50
+	rerankCandidates   = 20
+)
+
+// Chunks returned by /retrieve unless ?k= is given, and at most
+const (
+	retrieveDefaultResults = 10
+	retrieveMaxResults     = 100
+)
+
+// Reranker scores how well documents answer a query, reading both at once,
+// which orders a short list better than comparing vectors
+type Reranker interface {
+	Rerank(query string, documents []string) ([]float64, error)
+}
+
+var reranker Reranker // nil unless rerank_url is set
+
+// newReranker returns the reranker configured in the settings, nil when
+// rerank_url isn't set
+func newReranker(settings GeneralSettings) Reranker {
+	if settings.RerankURL == "" {
+		return nil
+	}
+	return &httpReranker{
+		url:    rerankEndpoint(settings.RerankURL),
+		model:  settings.RerankModel,
+		apiKey: settings.RerankAPIKey,
+		client: &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// rerankEndpoint accepts the base URL of the API, such as
+// http://localhost:8080/v1, or the full /rerank URL
+func rerankEndpoint(baseURL string) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if strings.HasSuffix(baseURL, "/rerank") {
+		return baseURL
+	}
+	return baseURL + "/rerank"
+}
+
+// httpReranker calls a /rerank endpoint as served by llama.cpp, Infinity,
+// TEI, Jina or Cohere
+type httpReranker struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+func (r *httpReranker) Rerank(query string, documents []string) ([]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": r.model, "query": query, "documents": documents, "top_n": len(documents),
+	})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if r.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("rerank server: %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	var result struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	scores := make([]float64, len(documents))
+	scored := make([]bool, len(documents))
+	for _, item := range result.Results {
+		if item.Index < 0 || item.Index >= len(documents) {
+			return nil, errors.New("rerank server returned an invalid index")
+		}
+		scores[item.Index] = item.RelevanceScore
+		scored[item.Index] = true
+	}
+	for _, ok := range scored {
+		if !ok {
+			return nil, errors.New("rerank server skipped a document")
+		}
+	}
+	return scores, nil
+}
+
+// retrievalScores tells how a chunk was ranked, shown by ?debug=true. A rank
+// is 0 when the chunk wasn't among the candidates of that ranking.
+type retrievalScores struct {
+	VectorRank   int      `json:"vector_rank,omitempty"`
+	VectorScore  float32  `json:"vector_score"`
+	LexicalRank  int      `json:"lexical_rank,omitempty"`
+	LexicalScore float64  `json:"lexical_score,omitempty"`
+	PathBoost    float64  `json:"path_boost,omitempty"`
+	Fused        float64  `json:"fused"`
+	Rerank       *float64 `json:"rerank,omitempty"`
+}
+
+// retrievedChunk is a chunk found by retrieve, with the fused score, or the
+// score of the reranker when there is one
+type retrievedChunk struct {
+	chunk
+	Score  float64          `json:"score"`
+	Scores *retrievalScores `json:"scores,omitempty"`
+}
+
+// retrieve returns the k chunks of a project that best answer the query,
+// fusing the ranking by meaning with the ranking by shared words, so a query
+// mixing identifiers and intent, such as "NewServer retry config", finds
+// both. Chunks of files whose path contains query terms are boosted, and the
+// best chunks are reordered by the reranker when one is configured.
+func retrieve(project string, config Config, query string, k int) ([]retrievedChunk, error) {
+	index, err := projectVectorIndex(project, config)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := embedder.Embed([]string{query})
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[int]*retrievalScores) // by chunk position
+	vectorRanking, vectorScores := index.rankByVector(vectors[0])
+	for rank, position := range vectorRanking {
+		if rank == retrieveCandidates {
+			break
+		}
+		scores[position] = &retrievalScores{VectorRank: rank + 1}
+	}
+	for rank, match := range index.lexical.search(query) {
+		if rank == retrieveCandidates {
+			break
+		}
+		if scores[match.chunk] == nil {
+			scores[match.chunk] = &retrievalScores{}
+		}
+		scores[match.chunk].LexicalRank = rank + 1
+		scores[match.chunk].LexicalScore = match.score
+	}
+
+	queryTerms := make(map[string]bool)
+	for _, term := range textTerms(query) {
+		queryTerms[term] = true
+	}
+	pathBoosts := make(map[string]float64)
+	results := make([]retrievedChunk, 0, len(scores))
+	for position, s := range scores {
+		c := index.chunks[position]
+		boost, ok := pathBoosts[c.Path]
+		if !ok {
+			boost = pathBoost(c.Path, queryTerms)
+			pathBoosts[c.Path] = boost
+		}
+		s.VectorScore = vectorScores[position]
+		s.PathBoost = boost
+		if s.VectorRank > 0 {
+			s.Fused += 1 / float64(rrfK+s.VectorRank)
+		}
+		if s.LexicalRank > 0 {
+			s.Fused += 1 / float64(rrfK+s.LexicalRank)
+		}
+		s.Fused += boost
+		results = append(results, retrievedChunk{chunk: c, Score: s.Fused, Scores: s})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Path != results[j].Path {
+			return results[i].Path < results[j].Path
+		}
+		return results[i].StartLine < results[j].StartLine
+	})
+
+	if reranker != nil {
+		n := k
+		if n < rerankCandidates {
+			n = rerankCandidates
+		}
+		if n > len(results) {
+			n = len(results)
+		}
+		results = results[:n]
+		documents := make([]string, n)
+		for i, result := range results {
+			documents[i] = embeddingText(result.chunk)
+		}
+		rerankScores, err := reranker.Rerank(query, documents)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			score := rerankScores[i]
+			results[i].Score = score
+			results[i].Scores.Rerank = &score
+		}
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	}
+
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// pathBoost is the share of the query terms found in a path, worth as much
+// as being first in a ranking when the path contains them all
+func pathBoost(path string, queryTerms map[string]bool) float64 {
+	if len(queryTerms) == 0 {
+		return 0
+	}
+	found := make(map[string]bool)
+	for _, term := range textTerms(path) {
+		if queryTerms[term] {
+			found[term] = true
+		}
+	}
+	return float64(len(found)) / float64(len(queryTerms)) / float64(rrfK+1)
+}
+
+// retrieveHandler serves the chunks of a project that best answer ?q=,
+// with the score of each ranking when ?debug=true
+func retrieveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing query, use ?q=", http.StatusBadRequest)
+		return
+	}
+	k, err := parseResultCount(r.URL.Query().Get("k"), retrieveDefaultResults, retrieveMaxResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	debug := r.URL.Query().Get("debug") == "true"
+
+	selectedConfig = configs[project+".json"]
+	results, err := retrieve(project, selectedConfig, query, k)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type result struct {
+		retrievedChunk
+		URL string `json:"url"`
+	}
+	response := struct {
+		Project  string   `json:"project"`
+		Query    string   `json:"query"`
+		Reranked bool     `json:"reranked"`
+		Results  []result `json:"results"`
+	}{Project: project, Query: query, Reranked: reranker != nil, Results: []result{}}
+	for _, found := range results {
+		if !debug {
+			found.Scores = nil
+		}
+		response.Results = append(response.Results, result{
+			retrievedChunk: found,
+			URL:            fmt.Sprintf("%s/f/%s%s", selectedConfig.ProjectURL, project, found.Path),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// projectRoot is a directory or archive served as part of a project. A
+// project with a single root_path has one root with an empty Name; a project
+// with roots shows each of them as a top-level directory named after it.
+type projectRoot struct {
+	Name   string
+	Path   string // on disk
+	FS     fs.FS  // the files under Path, read-only
+	Filter fileFilter
+}
+
+// projectRoots returns the roots of a project, each with its filter. A root
+// takes the filters it doesn't set from the project, and from the general
+// settings after that.
+func projectRoots(config Config) ([]projectRoot, error) {
+	if len(config.Roots) == 0 {
+		fsys, err := rootFS(config.RootPath)
+		if err != nil {
+			return nil, err
+		}
+		return []projectRoot{{Path: config.RootPath, FS: fsys, Filter: newFileFilter(config)}}, nil
+	}
+
+	roots := make([]projectRoot, 0, len(config.Roots))
+	for _, root := range config.Roots {
+		rootConfig := config
+		rootConfig.RootPath = root.RootPath
+		if root.InclusiveExtensions != "" {
+			rootConfig.InclusiveExtensions = root.InclusiveExtensions
+		}
+		if root.ExclusiveExtensions != "" {
+			rootConfig.ExclusiveExtensions = root.ExclusiveExtensions
+		}
+		if root.ExclusiveFolders != "" {
+			rootConfig.ExclusiveFolders = root.ExclusiveFolders
+		}
+		if root.ExclusiveFiles != "" {
+			rootConfig.ExclusiveFiles = root.ExclusiveFiles
+		}
+		if root.MaxFileSize != 0 {
+			rootConfig.MaxFileSize = root.MaxFileSize
+		}
+		fsys, err := rootFS(root.RootPath)
+		if err != nil {
+			return nil, err
+		}
+		filter := newFileFilter(rootConfig)
+		filter.Prefix = root.Name
+		roots = append(roots, projectRoot{Name: root.Name, Path: root.RootPath, FS: fsys, Filter: filter})
+	}
+	return roots, nil
+}
+
+// resolvePath maps a path of the project to the root it belongs to and to
+// its name in the root's FS. In a project with several roots the top-level ""
+// is the list of roots itself, for which no root is returned.
+func resolvePath(config Config, relativePath string) (*projectRoot, string, error) {
+	relativePath = strings.Trim(filepath.ToSlash(relativePath), "/")
+	roots, err := projectRoots(config)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(config.Roots) == 0 {
+		name, err := fsName(relativePath)
+		return &roots[0], name, err
+	}
+	if relativePath == "" {
+		return nil, "", nil
+	}
+
+	rootName, rest, _ := strings.Cut(relativePath, "/")
+	for i := range roots {
+		if roots[i].Name == rootName {
+			name, err := fsName(rest)
+			return &roots[i], name, err
+		}
+	}
+	return nil, "", &fs.PathError{Op: "open", Path: "/" + relativePath, Err: fs.ErrNotExist}
+}
+
+// resolveFile is resolvePath for a file, which the list of roots isn't
+func resolveFile(config Config, relativePath string) (*projectRoot, string, error) {
+	root, name, err := resolvePath(config, relativePath)
+	if err == nil && root == nil {
+		err = &fs.PathError{Op: "open", Path: "/", Err: fs.ErrInvalid}
+	}
+	return root, name, err
+}
+
+// fsName turns a slash separated path relative to a root into a name of its
+// FS, which can't leave the root
+func fsName(relativePath string) (string, error) {
+	name := path.Clean("/" + relativePath)[1:]
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: relativePath, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+// diskPath is where a file of the root is on disk, for a directory root. It
+// also keys the file in the cache.
+func (r *projectRoot) diskPath(name string) string {
+	return filepath.Join(r.Path, filepath.FromSlash(name))
+}
+
+// readDir returns the entries of a directory of the root sorted by name
+func (r *projectRoot) readDir(name string) ([]fs.DirEntry, error) {
+	return cache.readDir(r.FS, name, r.diskPath(name))
+}
+
+// walk calls fn for every file under the directory name that passes the
+// root's filter and for every directory that isn't excluded, before
+// descending into it, in directory order, with its slash separated path
+// relative to the project. relativePath is the path of the directory
+// relative to the project.
+func (r *projectRoot) walk(name, relativePath string, fn func(name, fileRelativePath string, entry fs.DirEntry) error) error {
+	files, err := r.readDir(name)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		fileName := file.Name()
+		if r.Filter.skipHidden(fileName) {
+			continue // Skip hidden files and directories
+		}
+		if contains(r.Filter.ExclusiveFiles, fileName) {
+			continue // Skip exclusive files
+		}
+		fileFSName := path.Join(name, fileName)
+		fileRelativePath := path.Join(relativePath, fileName)
+		if file.IsDir() {
+			if r.Filter.excludeDir(fileRelativePath, fileName) {
+				continue
+			}
+			if err := fn(fileFSName, fileRelativePath, file); err != nil {
+				return err
+			}
+			if err := r.walk(fileFSName, fileRelativePath, fn); err != nil {
+				return err
+			}
+		} else if r.Filter.includeFile(fileName) {
+			if err := fn(fileFSName, fileRelativePath, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rootEntries lists the roots of a project with several of them as
+// directories, in the order they are declared
+func rootEntries(config Config) ([]fs.DirEntry, error) {
+	roots, err := projectRoots(config)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fs.DirEntry
+	for _, root := range roots {
+		info, err := os.Stat(root.Path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, rootDirEntry{FileInfo: info, name: root.Name})
+	}
+	return entries, nil
+}
+
+// rootDirEntry is the directory of a root, named after the root rather than
+// after its directory on disk
+type rootDirEntry struct {
+	fs.FileInfo
+	name string
+}
+
+func (e rootDirEntry) Name() string               { return e.name }
+func (e rootDirEntry) IsDir() bool                { return true }
+func (e rootDirEntry) Type() fs.FileMode          { return fs.ModeDir }
+func (e rootDirEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+// walkProject calls fn like projectRoot.walk for everything under
+// relativePath, each root being walked with its own filter. Walking the top
+// of a project with several roots visits every root as a directory first.
+func walkProject(config Config, relativePath string, fn func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error) error {
+	root, name, err := resolvePath(config, relativePath)
+	if err != nil {
+		return err
+	}
+	if root != nil {
+		return root.walk(name, strings.Trim(filepath.ToSlash(relativePath), "/"), func(name, fileRelativePath string, entry fs.DirEntry) error {
+			return fn(root, name, fileRelativePath, entry)
+		})
+	}
+
+	entries, err := rootEntries(config)
+	if err != nil {
+		return err
+	}
+	roots, err := projectRoots(config)
+	if err != nil {
+		return err
+	}
+	for i := range roots {
+		root := &roots[i]
+		if err := fn(root, ".", root.Name, entries[i]); err != nil {
+			return err
+		}
+		err := root.walk(".", root.Name, func(name, fileRelativePath string, entry fs.DirEntry) error {
+			return fn(root, name, fileRelativePath, entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkProjectFiles is like walkProject but only calls fn for files
+func walkProjectFiles(config Config, relativePath string, fn func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error) error {
+	return walkProject(config, relativePath, func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			return nil
+		}
+		return fn(root, name, fileRelativePath, entry)
+	})
+}
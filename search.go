@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+// Longest line text returned for a match, in bytes
+const maxSearchLineLength = 300
+
+// searchMatch is a line of a file matching a search
+type searchMatch struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+var errSearchLimit = errors.New("search limit reached")
+
+// searchProject looks for query in every line of the files under
+// relativePath that /c would include. A plain query is matched ignoring
+// case, a regular expression as written. With redact, the lines are masked
+// before they are matched, so a query can't probe a secret. It stops after
+// maxResults matches and tells whether there were more.
+func searchProject(config Config, relativePath, query string, isRegex bool, maxResults int, redact bool) ([]searchMatch, bool, error) {
+	if query == "" {
+		return nil, false, errors.New("empty query")
+	}
+	pattern := "(?i)" + regexp.QuoteMeta(query)
+	if isRegex {
+		pattern = query
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matches := []searchMatch{}
+	err = walkProjectFiles(config, relativePath, func(root *projectRoot, name, fileRelativePath string, _ fs.DirEntry) error {
+		data, skipped, err := root.readTextFile(name)
+		if err != nil || skipped != "" {
+			return err
+		}
+		text := string(data)
+		if redact {
+			text, _ = redactText(config, "/"+fileRelativePath, text)
+		}
+		for i, line := range strings.Split(text, "\n") {
+			if !re.MatchString(line) {
+				continue
+			}
+			if len(matches) == maxResults {
+				return errSearchLimit
+			}
+			line = strings.TrimRight(line, "\r")
+			if len(line) > maxSearchLineLength {
+				line = strings.ToValidUTF8(line[:maxSearchLineLength], "") + "..."
+			}
+			matches = append(matches, searchMatch{Path: "/" + fileRelativePath, Line: i + 1, Text: line})
+		}
+		return nil
+	})
+	if err == errSearchLimit {
+		return matches, true, nil
+	}
+	return matches, false, err
+}
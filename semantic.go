@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Lines in a chunk, and lines shared by consecutive chunks of a file
+const (
+	chunkLines   = 40
+	chunkOverlap = 10
+)
+
+// Chunks returned by /semantic unless ?k= is given, and at most
+const (
+	semanticDefaultResults = 10
+	semanticMaxResults     = 100
+)
+
+// chunk is a span of lines of a file, the unit that is indexed and returned
+type chunk struct {
+	Path      string `json:"path"` // in the project, with a leading slash
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Text      string `json:"content"`
+}
+
+// chunkFile splits the content of a file into overlapping spans of lines
+func chunkFile(path, content string) []chunk {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var chunks []chunk
+	for start := 0; start < len(lines); start += chunkLines - chunkOverlap {
+		end := start + chunkLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		text := strings.Join(lines[start:end], "")
+		if strings.TrimSpace(text) != "" {
+			chunks = append(chunks, chunk{Path: path, StartLine: start + 1, EndLine: end, Text: text})
+		}
+		if end == len(lines) {
+			break
+		}
+	}
+	return chunks
+}
+
+// embeddingText is what gets embedded for a chunk: its path tells a lot
+// about what the code does
+func embeddingText(c chunk) string {
+	return c.Path + "\n" + c.Text
+}
+
+// vectorIndex holds the chunks of a project with their embeddings, file by
+// file, so only the files that changed need to be embedded again
+type vectorIndex struct {
+	fingerprint string // of the tree it was last updated from
+	EmbedderID  string
+	Redaction   string                  // from redactionKey
+	Files       map[string]*indexedFile // by path in the project
+
+	// Every chunk and its vector, in the order of the files
+	chunks  []chunk
+	vectors [][]float32
+	lexical *lexicalIndex
+}
+
+// indexedFile is a file of a vectorIndex, with what tells whether it changed
+type indexedFile struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string // sha256 of the content
+	Chunks  []chunk
+	Vectors [][]float32
+}
+
+// scoredChunk is a chunk found by a search
+type scoredChunk struct {
+	chunk
+	Score float32 `json:"score"`
+}
+
+// updateVectorIndex indexes every file /c would include, reusing the chunks
+// and vectors of previous for the files whose size and modification time,
+// or else content, didn't change. The chunks are masked as redactionKey
+// tells. It tells whether anything changed.
+func updateVectorIndex(previous *vectorIndex, config Config, embedder Embedder) (*vectorIndex, bool, error) {
+	index := &vectorIndex{EmbedderID: embedder.ID(), Redaction: redactionKey(config), Files: make(map[string]*indexedFile)}
+	if previous == nil || previous.EmbedderID != index.EmbedderID || previous.Redaction != index.Redaction {
+		previous = &vectorIndex{Files: make(map[string]*indexedFile)}
+	}
+
+	var paths []string
+	var pending []*indexedFile // to embed
+	changed := false
+	err := walkProjectFiles(config, "", func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		path := "/" + fileRelativePath
+		old := previous.Files[path]
+		if old != nil && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+			index.Files[path] = old
+			paths = append(paths, path)
+			return nil
+		}
+
+		data, skipped, err := root.readTextFile(name)
+		if err != nil || skipped != "" {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		file := &indexedFile{Size: info.Size(), ModTime: info.ModTime(), Hash: hex.EncodeToString(hash[:])}
+		if old != nil && old.Hash == file.Hash {
+			file.Chunks, file.Vectors = old.Chunks, old.Vectors
+		} else {
+			text := string(data)
+			if index.Redaction != "" {
+				text, _ = redactText(config, path, text)
+			}
+			file.Chunks = chunkFile(path, text)
+			pending = append(pending, file)
+		}
+		index.Files[path] = file
+		paths = append(paths, path)
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(index.Files) != len(previous.Files) {
+		changed = true // files were removed
+	}
+
+	var texts []string
+	for _, file := range pending {
+		for _, c := range file.Chunks {
+			texts = append(texts, embeddingText(c))
+		}
+	}
+	if len(texts) > 0 {
+		vectors, err := embedder.Embed(texts)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, file := range pending {
+			file.Vectors, vectors = vectors[:len(file.Chunks)], vectors[len(file.Chunks):]
+		}
+	}
+
+	for _, path := range paths {
+		file := index.Files[path]
+		index.chunks = append(index.chunks, file.Chunks...)
+		index.vectors = append(index.vectors, file.Vectors...)
+	}
+	index.lexical = buildLexicalIndex(index.chunks)
+	return index, changed, nil
+}
+
+// rankByVector returns the positions of every chunk, closest to the query
+// vector first, and the score of each chunk by position
+func (index *vectorIndex) rankByVector(query []float32) ([]int, []float32) {
+	scores := make([]float32, len(index.chunks))
+	ranking := make([]int, len(index.chunks))
+	for i := range index.chunks {
+		scores[i] = dot(query, index.vectors[i])
+		ranking[i] = i
+	}
+	sort.SliceStable(ranking, func(i, j int) bool { return scores[ranking[i]] > scores[ranking[j]] })
+	return ranking, scores
+}
+
+// search returns the k chunks closest to the query vector, best first
+func (index *vectorIndex) search(query []float32, k int) []scoredChunk {
+	ranking, scores := index.rankByVector(query)
+	if len(ranking) > k {
+		ranking = ranking[:k]
+	}
+	results := make([]scoredChunk, len(ranking))
+	for i, position := range ranking {
+		results[i] = scoredChunk{chunk: index.chunks[position], Score: scores[position]}
+	}
+	return results
+}
+
+var (
+	embedder Embedder = hashEmbedder{dimensions: hashEmbedderDimensions}
+
+	vectorIndexesMu sync.Mutex
+	vectorIndexes   = make(map[string]*vectorIndex) // by project
+	// Held while a project is indexed, which can take minutes with a remote
+	// embedder, so other projects can still be searched
+	vectorIndexLocks = make(map[string]*sync.Mutex)
+)
+
+// lockVectorIndex waits until no other request updates the index of the
+// project and returns the function releasing it
+func lockVectorIndex(project string) func() {
+	vectorIndexesMu.Lock()
+	lock := vectorIndexLocks[project]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		vectorIndexLocks[project] = lock
+	}
+	vectorIndexesMu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// projectVectorIndex returns the index of a project, updating it when a file
+// changed since it was last updated. The index is loaded from the data
+// directory the first time, and saved there after each update.
+func projectVectorIndex(project string, config Config) (*vectorIndex, error) {
+	fingerprint, _, err := treeETag(config, "", "semantic")
+	if err != nil {
+		return nil, err
+	}
+
+	defer lockVectorIndex(project)()
+	vectorIndexesMu.Lock()
+	index := vectorIndexes[project]
+	vectorIndexesMu.Unlock()
+	if index != nil && index.fingerprint == fingerprint && index.EmbedderID == embedder.ID() && index.Redaction == redactionKey(config) {
+		return index, nil
+	}
+
+	file := indexFile(project)
+	if index == nil {
+		index, err = loadVectorIndex(file)
+		if err != nil {
+			fmt.Println("Rebuilding the index of", project+":", err)
+		}
+	}
+	index, changed, err := updateVectorIndex(index, config, embedder)
+	if err != nil {
+		return nil, err
+	}
+	index.fingerprint = fingerprint
+	vectorIndexesMu.Lock()
+	vectorIndexes[project] = index
+	vectorIndexesMu.Unlock()
+	if changed {
+		if err := saveVectorIndex(file, index); err != nil {
+			// The index still works until the server restarts
+			fmt.Println("Error saving the index of", project+":", err)
+		}
+	}
+	return index, nil
+}
+
+// semanticSearch returns the k chunks of a project closest in meaning to the
+// query
+func semanticSearch(project string, config Config, query string, k int) ([]scoredChunk, error) {
+	index, err := projectVectorIndex(project, config)
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := embedder.Embed([]string{query})
+	if err != nil {
+		return nil, err
+	}
+	return index.search(vectors[0], k), nil
+}
+
+// parseResultCount reads the ?k= parameter
+func parseResultCount(value string, defaultCount, maxCount int) (int, error) {
+	if value == "" {
+		return defaultCount, nil
+	}
+	k, err := strconv.Atoi(value)
+	if err != nil || k <= 0 || k > maxCount {
+		return 0, fmt.Errorf("invalid k, expected a number from 1 to %d", maxCount)
+	}
+	return k, nil
+}
+
+// parseTokenBudget reads the ?budget= parameter
+func parseTokenBudget(value string, defaultBudget int) (int, error) {
+	if value == "" {
+		return defaultBudget, nil
+	}
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget <= 0 {
+		return 0, errors.New("invalid budget, expected a positive number of tokens")
+	}
+	return budget, nil
+}
+
+// semanticHandler serves the chunks of a project closest in meaning to ?q=
+func semanticHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing query, use ?q=", http.StatusBadRequest)
+		return
+	}
+	k, err := parseResultCount(r.URL.Query().Get("k"), semanticDefaultResults, semanticMaxResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	selectedConfig = configs[project+".json"]
+	results, err := semanticSearch(project, selectedConfig, query, k)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type result struct {
+		scoredChunk
+		URL string `json:"url"`
+	}
+	response := struct {
+		Project string   `json:"project"`
+		Query   string   `json:"query"`
+		Results []result `json:"results"`
+	}{Project: project, Query: query, Results: []result{}}
+	for _, found := range results {
+		response.Results = append(response.Results, result{
+			scoredChunk: found,
+			URL:         fmt.Sprintf("%s/f/%s%s", selectedConfig.ProjectURL, project, found.Path),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response)
+}
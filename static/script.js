@@ -5,6 +5,171 @@ document.addEventListener('DOMContentLoaded', (event) => {
         const item = event.target.closest('li');
         if (item && event.target.tagName === 'SPAN') {
             item.classList.toggle('expanded');
+            if (item.classList.contains('expanded')) {
+                loadChildren(item);
+            }
         }
     });
+
+    treeView.addEventListener('change', (event) => {
+        if (event.target.classList.contains('select-box')) {
+            updateBasketBar();
+        }
+    });
+    const createButton = document.querySelector('.basket-create');
+    if (createButton) {
+        createButton.addEventListener('click', () => createBasket(createButton));
+    }
 });
+
+// Paths of the checked files and directories
+function selectedPaths() {
+    return [...document.querySelectorAll('.select-box:checked')].map((box) => box.dataset.path);
+}
+
+function updateBasketBar() {
+    const count = selectedPaths().length;
+    document.querySelector('.basket-count').textContent =
+        count === 0 ? 'No files selected' : `${count} selected`;
+    document.querySelector('.basket-create').disabled = count === 0;
+}
+
+// Store the selection as a basket and show its URL
+function createBasket(button) {
+    const result = document.querySelector('.basket-result');
+    fetch(`/b/${button.dataset.project}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ paths: selectedPaths() }),
+    })
+        .then((response) => {
+            if (!response.ok) {
+                return response.text().then((text) => {
+                    throw new Error(text.trim() || response.statusText);
+                });
+            }
+            return response.json();
+        })
+        .then((basket) => {
+            const link = document.createElement('a');
+            link.href = basket.url;
+            link.target = '_blank';
+            link.textContent = basket.url;
+            result.replaceChildren(
+                link,
+                copyButton('copy-button', 'data-url', basket.external_url, 'Copy basket URL', 'green'),
+            );
+        })
+        .catch((error) => showToast(`Cannot create basket: ${error.message}`));
+}
+
+// Fetch the children of a directory from /api/tree the first time it expands
+function loadChildren(item) {
+    const url = item.getAttribute('data-children');
+    if (!url || item.dataset.loaded) {
+        return;
+    }
+    item.dataset.loaded = 'loading';
+    const list = item.querySelector(':scope > ul');
+    fetch(url)
+        .then((response) => {
+            if (!response.ok) {
+                throw new Error(response.statusText);
+            }
+            return response.json();
+        })
+        .then((tree) => {
+            list.replaceChildren(...tree.entries.map(renderEntry));
+            item.dataset.loaded = 'true';
+        })
+        .catch((error) => {
+            delete item.dataset.loaded;
+            item.classList.remove('expanded');
+            showToast(`Cannot load ${url}: ${error.message}`);
+        });
+}
+
+// Build the same markup as writeDirectory for one entry
+function renderEntry(entry) {
+    const li = document.createElement('li');
+    const div = document.createElement('div');
+    div.className = 'item';
+    li.appendChild(div);
+
+    if (entry.type === 'dir') {
+        // Sizes are only measured when the page was opened with them
+        li.setAttribute('data-children', annotateTree ? `${entry.links.children}?annotate=true` : entry.links.children);
+        const span = document.createElement('span');
+        span.textContent = entry.name;
+        const stats = document.createElement('small');
+        stats.className = 'stats';
+        stats.textContent = entry.stats ? entry.stats.summary : '';
+        div.append(
+            selectBox(entry.path),
+            span,
+            ' ',
+            stats,
+            iconLink(entry.links.structure, 'Display structure in directory', 'fa-sitemap', 'orange'),
+            iconLink(entry.links.contents, 'Display file content in directory', 'fa-file-code', '#6495ED'),
+            copyButton('copy-button', 'data-url', entry.links.structure_url, 'Copy structure URL', '#20B2AA'),
+            copyButton('copy-button', 'data-url', entry.links.contents_url, 'Copy file-content URL', 'green'),
+            iconLink(entry.links.zip, 'Download file content as zip', 'fa-file-archive', '#CD853F'),
+        );
+        li.appendChild(document.createElement('ul'));
+        return li;
+    }
+
+    const link = document.createElement('a');
+    link.href = entry.links.view;
+    link.target = '_blank';
+    link.title = 'Display in internal URL';
+    link.textContent = entry.name;
+    div.append(
+        selectBox(entry.path),
+        ' ',
+        link,
+        ' ',
+        iconLink(entry.links.file_url, 'Display in external URL', 'fa-external-link-alt', 'orange'),
+        copyButton('copy-button', 'data-url', entry.links.file_url, 'Copy external URL', '#20B2AA'),
+        copyButton('copy-button-info', 'data-info', entry.links.info, 'Copy external URL with path', ''),
+        iconLink(entry.links.json_url, 'Display content in JSON with line numnbers', 'fa-file-code', '#87CEFA'),
+    );
+    return li;
+}
+
+function selectBox(path) {
+    const box = document.createElement('input');
+    box.type = 'checkbox';
+    box.className = 'select-box';
+    box.dataset.path = path;
+    box.title = 'Add to basket';
+    return box;
+}
+
+function icon(name, color) {
+    const i = document.createElement('i');
+    i.className = `fas ${name}`;
+    if (color) {
+        i.style.color = color;
+    }
+    return i;
+}
+
+function iconLink(href, title, iconName, color) {
+    const a = document.createElement('a');
+    a.href = href;
+    a.target = '_blank';
+    a.className = 'buttons';
+    a.title = title;
+    a.appendChild(icon(iconName, color));
+    return a;
+}
+
+function copyButton(className, attribute, value, title, color) {
+    const button = document.createElement('button');
+    button.className = `${className} buttons`;
+    button.setAttribute(attribute, value);
+    button.title = title;
+    button.appendChild(icon('fa-copy', color));
+    return button;
+}
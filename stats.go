@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Number of entries in the largest files and deepest directories lists
+const statsTopCount = 10
+
+type languageStats struct {
+	Language string `json:"language"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+	Lines    int    `json:"lines"`
+	lineCounts
+}
+
+type fileSizeStats struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Lines int    `json:"lines"`
+}
+
+type dirDepthStats struct {
+	Path  string `json:"path"`
+	Depth int    `json:"depth"`
+	Files int    `json:"files"`
+}
+
+// projectStats describes the filtered tree of a project
+type projectStats struct {
+	Project            string           `json:"project"`
+	ProjectName        string           `json:"project_name"`
+	Path               string           `json:"path"`
+	Files              int              `json:"files"`
+	Directories        int              `json:"directories"`
+	Size               int64            `json:"size"`
+	Lines              int              `json:"lines"`
+	Tokens             int              `json:"tokens"`
+	Skipped            int              `json:"skipped"` // binary and oversized files, not counted in lines
+	Languages          []*languageStats `json:"languages"`
+	LargestFiles       []fileSizeStats  `json:"largest_files"`
+	DeepestDirectories []dirDepthStats  `json:"deepest_directories"`
+	lineCounts
+
+	topDirectories map[string]*treeStats // of the directories right under Path, by path
+}
+
+// topDirectory returns the path of the directory right under relativePath
+// holding a file, empty for a file of relativePath itself
+func topDirectory(relativePath, fileRelativePath string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(fileRelativePath, relativePath), "/")
+	if dir, _, nested := strings.Cut(rest, "/"); nested {
+		return "/" + strings.TrimPrefix(relativePath+"/"+dir, "/")
+	}
+	return ""
+}
+
+// addToDirectory counts a file in the totals of its top directory
+func (s *projectStats) addToDirectory(dir string, file treeStats) {
+	if dir == "" {
+		return
+	}
+	total := s.topDirectories[dir]
+	if total == nil {
+		total = &treeStats{}
+		s.topDirectories[dir] = total
+	}
+	total.add(file)
+}
+
+// collectProjectStats walks the files /c would include under relativePath
+func collectProjectStats(config Config, project string, relativePath string) (*projectStats, error) {
+	relativePath = strings.Trim(filepath.ToSlash(relativePath), "/")
+	stats := &projectStats{
+		Project:     project,
+		ProjectName: config.ProjectName,
+		Path:        "/" + relativePath,
+
+		topDirectories: make(map[string]*treeStats),
+	}
+	languages := make(map[string]*languageStats)
+	dirFiles := make(map[string]int)
+	var files []fileSizeStats
+
+	err := walkProject(config, relativePath, func(root *projectRoot, name, fileRelativePath string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			stats.Directories++
+			dirFiles["/"+fileRelativePath] += 0
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stats.Files++
+		stats.Size += info.Size()
+		dirFiles["/"+filepath.ToSlash(filepath.Dir(fileRelativePath))]++
+		dir := topDirectory(relativePath, fileRelativePath)
+
+		data, skipped, err := root.readTextFile(name)
+		if err != nil {
+			return err
+		}
+		if skipped != "" {
+			stats.Skipped++
+			stats.addToDirectory(dir, treeStats{Files: 1, Size: info.Size()})
+			return nil
+		}
+
+		lang := languageOf(entry.Name())
+		langName := "Other"
+		if lang != nil {
+			langName = lang.Name
+		}
+		langStats := languages[langName]
+		if langStats == nil {
+			langStats = &languageStats{Language: langName}
+			languages[langName] = langStats
+		}
+		counts := countLineKinds(string(data), lang)
+		lines := countLines(data)
+		langStats.Files++
+		langStats.Size += info.Size()
+		langStats.Lines += lines
+		langStats.Code += counts.Code
+		langStats.Comments += counts.Comments
+		langStats.Blank += counts.Blank
+		tokens := estimateTokens(data)
+		stats.Lines += lines
+		stats.Tokens += tokens
+		stats.Code += counts.Code
+		stats.Comments += counts.Comments
+		stats.Blank += counts.Blank
+		files = append(files, fileSizeStats{Path: "/" + fileRelativePath, Size: info.Size(), Lines: lines})
+		stats.addToDirectory(dir, treeStats{Files: 1, Size: info.Size(), Lines: lines, Tokens: tokens})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Languages = []*languageStats{}
+	for _, langStats := range languages {
+		stats.Languages = append(stats.Languages, langStats)
+	}
+	sort.Slice(stats.Languages, func(i, j int) bool {
+		if stats.Languages[i].Code != stats.Languages[j].Code {
+			return stats.Languages[i].Code > stats.Languages[j].Code
+		}
+		return stats.Languages[i].Language < stats.Languages[j].Language
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Size != files[j].Size {
+			return files[i].Size > files[j].Size
+		}
+		return files[i].Path < files[j].Path
+	})
+	if len(files) > statsTopCount {
+		files = files[:statsTopCount]
+	}
+	stats.LargestFiles = append([]fileSizeStats{}, files...)
+
+	stats.DeepestDirectories = []dirDepthStats{}
+	for dir, count := range dirFiles {
+		if dir == "/." || dir == "/" {
+			continue // Files at the root
+		}
+		stats.DeepestDirectories = append(stats.DeepestDirectories, dirDepthStats{Path: dir, Depth: strings.Count(dir, "/"), Files: count})
+	}
+	sort.Slice(stats.DeepestDirectories, func(i, j int) bool {
+		a, b := stats.DeepestDirectories[i], stats.DeepestDirectories[j]
+		if a.Depth != b.Depth {
+			return a.Depth > b.Depth
+		}
+		return a.Path < b.Path
+	})
+	if len(stats.DeepestDirectories) > statsTopCount {
+		stats.DeepestDirectories = stats.DeepestDirectories[:statsTopCount]
+	}
+	return stats, nil
+}
+
+// statsHandler serves the statistics of a project as JSON, or as an HTML
+// page with ?format=html
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+	path := vars["relativePath"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "html" {
+		http.Error(w, "Invalid format, expected json or html", http.StatusBadRequest)
+		return
+	}
+
+	config := configs[project+".json"]
+	stats, err := collectProjectStats(config, project, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		if err := statsTemplate.Execute(w, stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+var statsTemplate = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"size":  formatSize,
+	"count": formatCount,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>{{.ProjectName}} statistics</title>
+<link rel="stylesheet" href="/static/style.css">
+<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/5.15.3/css/all.min.css">
+</head>
+<body>
+<a href="/p/{{.Project}}" class="back-button"><i class="fas fa-arrow-left"></i> {{.ProjectName}}</a>
+<h1>{{.ProjectName}} {{.Path}}</h1>
+<div class="stats-view">
+<p>{{.Files}} files in {{.Directories}} directories, {{size .Size}}, {{.Lines}} lines ({{.Code}} code, {{.Comments}} comments, {{.Blank}} blank), ~{{count .Tokens}} tokens.
+{{if .Skipped}}{{.Skipped}} binary or oversized files are not counted in lines.{{end}}
+<a href="?format=json">JSON</a></p>
+
+<h2>Languages</h2>
+<table>
+<tr><th>Language</th><th>Files</th><th>Code</th><th>Comments</th><th>Blank</th><th>Size</th></tr>
+{{range .Languages}}<tr><td>{{.Language}}</td><td>{{.Files}}</td><td>{{.Code}}</td><td>{{.Comments}}</td><td>{{.Blank}}</td><td>{{size .Size}}</td></tr>
+{{end}}</table>
+
+<h2>Largest files</h2>
+<table>
+<tr><th>File</th><th>Size</th><th>Lines</th></tr>
+{{range .LargestFiles}}<tr><td>{{.Path}}</td><td>{{size .Size}}</td><td>{{.Lines}}</td></tr>
+{{end}}</table>
+
+<h2>Deepest directories</h2>
+<table>
+<tr><th>Directory</th><th>Depth</th><th>Files</th></tr>
+{{range .DeepestDirectories}}<tr><td>{{.Path}}</td><td>{{.Depth}}</td><td>{{.Files}}</td></tr>
+{{end}}</table>
+</div>
+</body>
+</html>
+`))
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directory of the index files unless data_dir is set, next to settings.json
+const defaultDataDir = "data"
+
+// An index file starts with this line and the sha256 of the rest, which is
+// the gob encoded vectorIndex. The version changes with the format.
+const indexFileMagic = "MinRAGServer index 1\n"
+
+// indexFile is where the index of a project is kept
+func indexFile(project string) string {
+	dir := generalSettings.DataDir
+	if dir == "" {
+		dir = defaultDataDir
+	}
+	return filepath.Join(dir, project+".index")
+}
+
+// loadVectorIndex reads an index saved by saveVectorIndex. It returns nil
+// without error when there is none yet, and an error when the file is
+// corrupted or from another version, in which case the index is rebuilt.
+func loadVectorIndex(file string) (*vectorIndex, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(indexFileMagic)) {
+		return nil, fmt.Errorf("%s: not an index file of this version", file)
+	}
+	data = data[len(indexFileMagic):]
+	if len(data) < sha256.Size {
+		return nil, fmt.Errorf("%s: truncated", file)
+	}
+	sum, payload := data[:sha256.Size], data[sha256.Size:]
+	if actual := sha256.Sum256(payload); !bytes.Equal(sum, actual[:]) {
+		return nil, fmt.Errorf("%s: checksum mismatch", file)
+	}
+
+	var index vectorIndex
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for path, indexed := range index.Files {
+		if indexed == nil || len(indexed.Chunks) != len(indexed.Vectors) {
+			return nil, fmt.Errorf("%s: inconsistent entry for %s", file, path)
+		}
+	}
+	return &index, nil
+}
+
+// saveVectorIndex writes an index with its checksum, through a temporary file
+// so a crash can't leave half of it
+func saveVectorIndex(file string, index *vectorIndex) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(index); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(payload.Bytes())
+
+	var data bytes.Buffer
+	data.WriteString(indexFileMagic)
+	data.Write(sum[:])
+	data.Write(payload.Bytes())
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".tmp", data.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
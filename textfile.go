@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Number of leading bytes sniffed to tell binary files from text
+const binarySniffLength = 8000
+
+// readTextFile reads a file of the root unless it is binary or larger than
+// the root's max_file_size, in which case the data is nil and skipped tells
+// why it was left out.
+func (r *projectRoot) readTextFile(name string) (data []byte, skipped string, err error) {
+	maxFileSize := r.Filter.MaxFileSize
+	filePath := r.diskPath(name)
+	cached, generation := cache.lookupFile(r.FS, name, filePath)
+	if cached != nil {
+		return textFileResult(cached.data, cached.binary, cached.fileLen, maxFileSize)
+	}
+
+	file, err := r.FS.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	if maxFileSize > 0 && info.Size() > maxFileSize {
+		return textFileResult(nil, false, info.Size(), maxFileSize)
+	}
+
+	data, err = io.ReadAll(file)
+	if err != nil {
+		return nil, "", err
+	}
+	binary := isBinary(data)
+	if binary {
+		data = nil
+	}
+	cache.storeFile(filePath, generation, info, data, binary)
+	return textFileResult(data, binary, info.Size(), maxFileSize)
+}
+
+// textFileResult applies the size limit and binary check to a file read
+func textFileResult(data []byte, binary bool, size int64, maxFileSize int64) ([]byte, string, error) {
+	if maxFileSize > 0 && size > maxFileSize {
+		return nil, fmt.Sprintf("%d bytes exceeds max_file_size of %d bytes", size, maxFileSize), nil
+	}
+	if binary {
+		return nil, "binary file", nil
+	}
+	return data, "", nil
+}
+
+// isBinary sniffs the beginning of data the way git does, looking for a NUL
+// byte, and also treats a high share of control characters as binary.
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLength {
+		data = data[:binarySniffLength]
+	}
+	control := 0
+	for _, b := range data {
+		switch {
+		case b == 0:
+			return true
+		case b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\b' && b != 0x1b:
+			control++
+		}
+	}
+	return control*10 > len(data)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// treeEntry is a child of a directory in the project tree, with the links
+// the tree view shows for it
+type treeEntry struct {
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Type     string     `json:"type"` // "dir" or "file"
+	Size     int64      `json:"size"`
+	Modified time.Time  `json:"modified"`
+	Stats    *treeStats `json:"stats,omitempty"` // only when annotated
+	Links    treeLinks  `json:"links"`
+}
+
+type treeLinks struct {
+	// Directories
+	Children     string `json:"children,omitempty"`
+	Structure    string `json:"structure,omitempty"`
+	Contents     string `json:"contents,omitempty"`
+	StructureURL string `json:"structure_url,omitempty"`
+	ContentsURL  string `json:"contents_url,omitempty"`
+	Zip          string `json:"zip,omitempty"`
+
+	// Files
+	View    string `json:"view,omitempty"`
+	FileURL string `json:"file_url,omitempty"`
+	JSONURL string `json:"json_url,omitempty"`
+	Info    string `json:"info,omitempty"`
+}
+
+// listDirectory returns one level of the project tree under relativePath,
+// directories first, each group sorted by name. When annotate is set, every
+// entry is measured, directories with the totals of the files below them.
+// The roots of a project with several are listed at its top level, in the
+// order they are declared.
+func listDirectory(config Config, project string, relativePath string, annotate bool) ([]treeEntry, error) {
+	root, name, err := resolvePath(config, relativePath)
+	if err != nil {
+		return nil, err
+	}
+	var files []fs.DirEntry
+	if root != nil {
+		files, err = root.readDir(name)
+	} else {
+		files, err = rootEntries(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	relativePath = strings.Trim(filepath.ToSlash(relativePath), "/")
+
+	dirs := []treeEntry{}
+	filesOnly := []treeEntry{}
+	for _, file := range files {
+		entryPath := "/" + strings.TrimPrefix(relativePath+"/"+file.Name(), "/")
+		if root == nil {
+			entry, err := dirEntry(config, project, file, entryPath, annotate)
+			if err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, entry)
+			continue
+		}
+
+		filter := root.Filter
+		// Use the show_hidden property from the general settings
+		if filter.skipHidden(file.Name()) {
+			continue
+		}
+
+		if file.IsDir() {
+			if filter.excludeDir(entryPath, file.Name()) {
+				continue
+			}
+			entry, err := dirEntry(config, project, file, entryPath, annotate)
+			if err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, entry)
+		} else if filter.includeFile(file.Name()) {
+			entry := treeEntry{Name: file.Name(), Path: entryPath, Type: "file"}
+			entry.Links.View = fmt.Sprintf("/v/%s%s", project, entryPath)
+			entry.Links.FileURL = fmt.Sprintf("%s/f/%s%s", config.ProjectURL, project, entryPath)
+			entry.Links.JSONURL = fmt.Sprintf("%s/j/%s%s", config.ProjectURL, project, entryPath)
+			entry.Links.Info = fmt.Sprintf("%s: %s", file.Name(), entry.Links.FileURL)
+			if info, err := file.Info(); err == nil {
+				entry.Size = info.Size()
+				entry.Modified = info.ModTime()
+			}
+			if annotate {
+				stats := measureFile(root, filepath.ToSlash(filepath.Join(name, file.Name())), entry.Size, entry.Modified)
+				entry.Stats = &stats
+			}
+			filesOnly = append(filesOnly, entry)
+		}
+	}
+
+	if root != nil {
+		sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name < dirs[j].Name })
+	}
+	sort.Slice(filesOnly, func(i, j int) bool { return filesOnly[i].Name < filesOnly[j].Name })
+	return append(dirs, filesOnly...), nil
+}
+
+// dirEntry builds the tree entry of a directory, entryPath being its path in
+// the project
+func dirEntry(config Config, project string, file fs.DirEntry, entryPath string, annotate bool) (treeEntry, error) {
+	entry := treeEntry{Name: file.Name(), Path: entryPath, Type: "dir"}
+	entry.Links.Children = fmt.Sprintf("/api/tree/%s%s", project, entryPath)
+	entry.Links.Structure = fmt.Sprintf("/s/%s%s", project, entryPath)
+	entry.Links.Contents = fmt.Sprintf("/c/%s%s", project, entryPath)
+	entry.Links.StructureURL = config.ProjectURL + entry.Links.Structure
+	entry.Links.ContentsURL = config.ProjectURL + entry.Links.Contents
+	entry.Links.Zip = fmt.Sprintf("/z/%s%s", project, entryPath)
+	if info, err := file.Info(); err == nil {
+		entry.Modified = info.ModTime()
+	}
+	if annotate {
+		stats, err := measureDir(config, strings.TrimPrefix(entryPath, "/"))
+		if err != nil {
+			return entry, err
+		}
+		entry.Stats = &stats
+	}
+	return entry, nil
+}
+
+// treeHandler serves one directory level of a project as JSON, for the tree
+// view to load directories as they are expanded
+func treeHandler(w http.ResponseWriter, r *http.Request) {
+	// Check if the request is from a local IP
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if generalSettings.DisableExternalNetworkBrowsing && !isLocalIP(ip) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	project := vars["project_json_name"]
+	path := vars["relativePath"]
+
+	if project == "" || configs[project+".json"].ProjectName == "" {
+		http.Error(w, "Invalid project", http.StatusBadRequest)
+		return
+	}
+
+	config := configs[project+".json"]
+	annotate := r.URL.Query().Get("annotate") == "true"
+	entries, err := listDirectory(config, project, path, annotate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"project": project,
+		"path":    "/" + strings.Trim(filepath.ToSlash(path), "/"),
+		"entries": entries,
+	}
+	if annotate {
+		response["totals"] = sumEntries(entries)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// sumEntries rolls up the stats of an annotated directory level
+func sumEntries(entries []treeEntry) treeStats {
+	var total treeStats
+	for _, entry := range entries {
+		if entry.Stats != nil {
+			total.add(*entry.Stats)
+		}
+	}
+	total.summarize(true)
+	return total
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A problem found by the validate command. Warnings are reported but don't
+// make the command fail.
+type validationProblem struct {
+	File    string
+	Warning bool
+	Message string
+}
+
+type validator struct {
+	problems []validationProblem
+}
+
+func (v *validator) errorf(file string, format string, args ...interface{}) {
+	v.problems = append(v.problems, validationProblem{File: file, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(file string, format string, args ...interface{}) {
+	v.problems = append(v.problems, validationProblem{File: file, Warning: true, Message: fmt.Sprintf(format, args...)})
+}
+
+// runValidate loads settings.json and every project config, prints all the
+// problems found and returns the process exit code.
+func runValidate() int {
+	v := &validator{}
+
+	var settings GeneralSettings
+	settingsOK := v.decodeFile("settings.json", &settings)
+	if settingsOK {
+		v.checkSettings("settings.json", settings)
+	}
+	// The file filters of the checks fall back to the general settings
+	generalSettings = settings
+
+	files, err := os.ReadDir("config")
+	if err != nil {
+		v.errorf("config", "cannot read config directory: %v", err)
+	}
+
+	projectFiles := make(map[string]string) // project name -> first config file declaring it
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		configPath := filepath.Join("config", file.Name())
+		var config Config
+		if !v.decodeFile(configPath, &config) {
+			continue
+		}
+		if config.ProjectName == "" {
+			v.errorf(configPath, "project_name is missing")
+		} else if first, ok := projectFiles[config.ProjectName]; ok {
+			v.errorf(configPath, "duplicate project_name %q, already declared in %s", config.ProjectName, first)
+		} else {
+			projectFiles[config.ProjectName] = configPath
+		}
+		v.checkConfig(configPath, config, settings)
+	}
+
+	errors, warnings := 0, 0
+	for _, problem := range v.problems {
+		level := "error"
+		if problem.Warning {
+			level = "warning"
+			warnings++
+		} else {
+			errors++
+		}
+		fmt.Printf("%s: %s: %s\n", problem.File, level, problem.Message)
+	}
+	fmt.Printf("%d error(s), %d warning(s)\n", errors, warnings)
+
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// decodeFile reads a JSON object into target, reporting unknown keys, those
+// of the roots and bundles included, and decoding errors. It returns false if
+// the file couldn't be used at all.
+func (v *validator) decodeFile(path string, target interface{}) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		v.errorf(path, "cannot read file: %v", err)
+		return false
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		v.errorf(path, "invalid JSON: %v", err)
+		return false
+	}
+
+	for _, key := range unknownKeys(raw, reflect.TypeOf(target), "") {
+		v.errorf(path, "unknown key %q", key)
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		v.errorf(path, "invalid value: %v", err)
+		return false
+	}
+	return true
+}
+
+func (v *validator) checkSettings(path string, settings GeneralSettings) {
+	if settings.ServerPort == "" {
+		v.errorf(path, "server_port is missing")
+	}
+	if settings.MaxFileSize < 0 {
+		v.errorf(path, "max_file_size must not be negative")
+	}
+	if settings.CacheMaxBytes < 0 {
+		v.errorf(path, "cache_max_bytes must not be negative")
+	}
+	if settings.CompressionMinSize < 0 {
+		v.errorf(path, "compression_min_size must not be negative")
+	}
+	if settings.PublicURL != "" {
+		if u, err := url.Parse(settings.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path, "public_url %q must be an absolute http or https URL", settings.PublicURL)
+		}
+	}
+	if settings.EmbeddingURL != "" {
+		if u, err := url.Parse(settings.EmbeddingURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path, "embedding_url %q must be an absolute http or https URL", settings.EmbeddingURL)
+		}
+		if settings.EmbeddingModel == "" {
+			v.errorf(path, "embedding_model is missing, it is required with embedding_url")
+		}
+	}
+	if settings.RerankURL != "" {
+		if u, err := url.Parse(settings.RerankURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path, "rerank_url %q must be an absolute http or https URL", settings.RerankURL)
+		}
+	}
+	if settings.ChatURL != "" {
+		if u, err := url.Parse(settings.ChatURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(path, "chat_url %q must be an absolute http or https URL", settings.ChatURL)
+		}
+		if settings.ChatModel == "" {
+			v.errorf(path, "chat_model is missing, it is required with chat_url")
+		}
+	}
+	switch settings.RedactSecrets {
+	case "", redactExternal, redactAlways, redactNever:
+	default:
+		v.errorf(path, "redact_secrets %q must be %s, %s or %s", settings.RedactSecrets, redactExternal, redactAlways, redactNever)
+	}
+	v.checkExtensionList(path, "inclusive_extensions", settings.InclusiveExtensions, true)
+	v.checkExtensionList(path, "exclusive_extensions", settings.ExclusiveExtensions, false)
+	v.checkFolderList(path, "exclusive_folders", settings.ExclusiveFolders)
+}
+
+func (v *validator) checkConfig(path string, config Config, settings GeneralSettings) {
+	v.checkExtensionList(path, "inclusive_extensions", config.InclusiveExtensions, true)
+	v.checkExtensionList(path, "exclusive_extensions", config.ExclusiveExtensions, false)
+	v.checkFolderList(path, "exclusive_folders", config.ExclusiveFolders)
+
+	if config.ProjectURL == "" {
+		v.errorf(path, "project_url is missing")
+	} else if u, err := url.Parse(config.ProjectURL); err != nil {
+		v.errorf(path, "project_url %q is invalid: %v", config.ProjectURL, err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(path, "project_url %q must be an absolute http or https URL", config.ProjectURL)
+	} else if u.Path != "" && u.Path != "/" {
+		v.errorf(path, "project_url %q must not contain a path", config.ProjectURL)
+	}
+
+	v.checkBundles(path, config)
+	for i, pattern := range config.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.errorf(path, "redact_patterns[%d]: %v", i, err)
+		}
+	}
+
+	if len(config.Roots) > 0 {
+		if config.RootPath != "" {
+			v.errorf(path, "root_path and roots can't both be set")
+		}
+		names := make(map[string]bool)
+		for i, root := range config.Roots {
+			label := fmt.Sprintf("roots[%d]", i)
+			switch {
+			case root.Name == "":
+				v.errorf(path, "%s name is missing", label)
+			case strings.ContainsAny(root.Name, "/\\"):
+				v.errorf(path, "%s name %q must not contain a slash", label, root.Name)
+			case names[root.Name]:
+				v.errorf(path, "%s name %q is used by another root", label, root.Name)
+			}
+			names[root.Name] = true
+			v.checkExtensionList(path, label+" inclusive_extensions", root.InclusiveExtensions, true)
+			v.checkExtensionList(path, label+" exclusive_extensions", root.ExclusiveExtensions, false)
+			v.checkFolderList(path, label+" exclusive_folders", root.ExclusiveFolders)
+			if root.RootPath == "" {
+				v.errorf(path, "%s root_path is missing", label)
+				continue
+			}
+
+			// A root inherits the project's exclusive folders, then the general ones
+			exclusiveFolders, source := root.ExclusiveFolders, label+" exclusive_folders"
+			if exclusiveFolders == "" {
+				exclusiveFolders, source = config.ExclusiveFolders, "exclusive_folders"
+			}
+			if exclusiveFolders == "" {
+				exclusiveFolders, source = settings.ExclusiveFolders, "exclusive_folders inherited from settings.json"
+			}
+			v.checkRootPath(path, label+" root_path", root.RootPath, exclusiveFolders, source, settings)
+		}
+		return
+	}
+
+	if config.RootPath == "" {
+		v.errorf(path, "root_path is missing")
+		return
+	}
+
+	// The project inherits the general exclusive folders when it has none
+	exclusiveFolders := config.ExclusiveFolders
+	source := "exclusive_folders"
+	if exclusiveFolders == "" {
+		exclusiveFolders = settings.ExclusiveFolders
+		source = "exclusive_folders inherited from settings.json"
+	}
+	v.checkRootPath(path, "root_path", config.RootPath, exclusiveFolders, source, settings)
+}
+
+// checkBundles checks the names and paths of the bundles and warns about the
+// paths that match no file of the project
+func (v *validator) checkBundles(path string, config Config) {
+	names := make(map[string]bool)
+	for i, bundle := range config.Bundles {
+		label := fmt.Sprintf("bundles[%d]", i)
+		switch {
+		case bundle.Name == "":
+			v.errorf(path, "%s name is missing", label)
+		case strings.ContainsAny(bundle.Name, "/\\"):
+			v.errorf(path, "%s name %q must not contain a slash", label, bundle.Name)
+		case names[bundle.Name]:
+			v.errorf(path, "%s name %q is used by another bundle", label, bundle.Name)
+		}
+		names[bundle.Name] = true
+		if len(bundle.Paths) == 0 {
+			v.errorf(path, "%s has no paths", label)
+		}
+		valid := len(bundle.Paths) > 0
+		for _, item := range bundle.Paths {
+			if _, err := parseBundleEntry(item); err != nil {
+				v.errorf(path, "%s: %v", label, err)
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+		files, err := collectBundleContents(config, bundle, false)
+		if errors.Is(err, errDirectoryRange) {
+			v.errorf(path, "%s: %v", label, err)
+			continue
+		}
+		if err != nil {
+			continue // the root paths are reported below
+		}
+		for _, file := range files {
+			if file.Skipped == "no longer exists" {
+				v.warnf(path, "%s path %q doesn't exist", label, file.Path)
+			}
+		}
+		if len(files) == 0 {
+			v.warnf(path, "%s %q matches no file", label, bundle.Name)
+		}
+	}
+}
+
+// checkRootPath checks that rootPath is a directory or a readable archive and
+// warns about the exclusive folder patterns that match nothing under it
+func (v *validator) checkRootPath(path string, key string, rootPath string, exclusiveFolders string, source string, settings GeneralSettings) {
+	info, err := os.Stat(rootPath)
+	if err != nil {
+		v.errorf(path, "%s %q: %v", key, rootPath, err)
+		return
+	}
+	if !info.IsDir() && !isArchive(rootPath) {
+		v.errorf(path, "%s %q is not a directory or a .zip, .tar or .tar.gz archive", key, rootPath)
+		return
+	}
+	fsys, err := rootFS(rootPath)
+	if err != nil {
+		v.errorf(path, "%s %q: %v", key, rootPath, err)
+		return
+	}
+
+	for _, pattern := range unmatchedFolderPatterns(fsys, splitList(exclusiveFolders), settings.ShowHidden) {
+		v.warnf(path, "%s pattern %q matches no folder under %s", source, pattern, rootPath)
+	}
+}
+
+// checkExtensionList checks a comma separated list of extensions, allowWildcard
+// telling whether it may start with "*" for every extension
+func (v *validator) checkExtensionList(path string, key string, list string, allowWildcard bool) {
+	if list == "" {
+		return
+	}
+	seen := make(map[string]bool)
+	for i, ext := range strings.Split(list, ",") {
+		switch {
+		case ext == "":
+			v.errorf(path, "%s has an empty entry at position %d", key, i+1)
+		case ext != strings.TrimSpace(ext):
+			v.errorf(path, "%s entry %q has surrounding whitespace", key, ext)
+		case strings.HasPrefix(ext, "."):
+			v.errorf(path, "%s entry %q must not start with a dot", key, ext)
+		case ext == "*":
+			if !allowWildcard || i != 0 {
+				v.errorf(path, "%s entry \"*\" is only supported as the first inclusive extension", key)
+			}
+		case strings.ContainsAny(ext, "/\\*?"):
+			v.errorf(path, "%s entry %q is not a file extension", key, ext)
+		case seen[ext]:
+			v.warnf(path, "%s entry %q is listed more than once", key, ext)
+		}
+		seen[ext] = true
+	}
+}
+
+func (v *validator) checkFolderList(path string, key string, list string) {
+	if list == "" {
+		return
+	}
+	for i, folder := range strings.Split(list, ",") {
+		switch {
+		case folder == "":
+			v.errorf(path, "%s has an empty entry at position %d", key, i+1)
+		case folder == "*":
+			v.errorf(path, "%s entry \"*\" is not supported, a * must be followed by a folder name as in *build", key)
+		case folder != strings.TrimSpace(folder):
+			v.errorf(path, "%s entry %q has surrounding whitespace", key, folder)
+		case strings.HasPrefix(folder, "/") || strings.HasSuffix(folder, "/"):
+			v.errorf(path, "%s entry %q must not start or end with a slash", key, folder)
+		case strings.Contains(folder, "\\"):
+			v.errorf(path, "%s entry %q must use forward slashes", key, folder)
+		case strings.HasPrefix(folder, "*") && strings.Contains(folder, "/"):
+			v.errorf(path, "%s entry %q: a * pattern matches a folder name and can't contain a slash", key, folder)
+		}
+	}
+}
+
+// unmatchedFolderPatterns walks the files of a root and returns the exclusive
+// folder patterns that don't exclude any directory.
+func unmatchedFolderPatterns(fsys fs.FS, patterns []string, showHidden bool) []string {
+	matched := make(map[string]bool)
+	fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == "." {
+			return nil
+		}
+		if !showHidden && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		relativePath := "/" + path
+		excluded := false
+		for _, pattern := range patterns {
+			if checkExclusiveDir([]string{pattern}, relativePath, d.Name()) {
+				matched[pattern] = true
+				excluded = true
+			}
+		}
+		if excluded {
+			return fs.SkipDir
+		}
+		return nil
+	})
+
+	var unmatched []string
+	for _, pattern := range patterns {
+		if pattern != "" && !matched[pattern] {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	return unmatched
+}
+
+// Helper function to split a comma separated setting, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// jsonFields returns the type of each field of a struct by the JSON key its
+// tag declares.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	return fields
+}
+
+// unknownKeys returns the keys of raw that the struct type t doesn't declare,
+// sorted. The objects of its arrays of structs, such as roots and bundles,
+// are checked too, their keys named like roots[0].root_path.
+func unknownKeys(raw map[string]json.RawMessage, t reflect.Type, prefix string) []string {
+	fields := jsonFields(t)
+	var unknown []string
+	for key, value := range raw {
+		field, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+		if field.Kind() != reflect.Slice || field.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		var items []map[string]json.RawMessage
+		if json.Unmarshal(value, &items) != nil {
+			continue // reported when the file is decoded
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownKeys(item, field.Elem(), fmt.Sprintf("%s%s[%d].", prefix, key, i))...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}